@@ -0,0 +1,370 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Agent mode, "colibri agent [flags]", runs as a DaemonSet and profiles every container on the node.
+// The containers are found under the kubepods cgroup hierarchy, with both the systemd and cgroupfs drivers:
+//   /kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod<uid>.slice/cri-containerd-<id>.scope
+//   /kubepods/burstable/pod<uid>/<id>
+// One scheduler samples all of them every span, and the hierarchy is rescanned for containers
+// appearing and disappearing. Like daemon mode, every container has a summary of every window.
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	kubepodsDirs = []string{"/kubepods.slice", "/kubepods"}
+	// the Pod directory, the UID has underscores instead of dashes with the systemd driver
+	podDirRegexp      = regexp.MustCompile(`^(?:kubepods-(?:burstable-|besteffort-)?)?pod([0-9a-f_-]+)(?:\.slice)?$`)
+	containerIdRegexp = regexp.MustCompile(`[0-9a-f]{64}`)
+)
+
+// containerInfo is a container found under the kubepods hierarchy
+type containerInfo struct {
+	// the cgroup path relative to the hierarchy
+	path        string
+	podUid      string
+	containerId string
+	qosClass    string
+	pid         int
+	command     string
+}
+
+// agentTarget is a container sampled by the agent
+type agentTarget struct {
+	info       containerInfo
+	collectors []collector
+	summaries  *summarizer
+	prom       sink
+
+	// the numbers of the current tick
+	values []float64
+	err    error
+}
+
+type agent struct {
+	o        *options
+	metrics  []metric
+	exporter *promExporter
+	file     *rotatingFile
+
+	targets []*agentTarget
+}
+
+// discoverContainers lists the containers under the kubepods hierarchy, except the pause containers of Pods
+func discoverContainers() ([]containerInfo, error) {
+
+	root := cgroupHierarchy()
+	var containers []containerInfo
+
+	for _, top := range kubepodsDirs {
+		err := filepath.WalkDir(root+top, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// the top directory of the other cgroup driver, or removed in between
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if !d.IsDir() {
+				return nil
+			}
+
+			m := podDirRegexp.FindStringSubmatch(d.Name())
+			if m == nil {
+				return nil
+			}
+			containers = append(containers, podContainers(strings.TrimPrefix(path, root), m[1])...)
+			return filepath.SkipDir
+		})
+		if err != nil {
+			return nil, fileError(errCgroup, err)
+		}
+	}
+	return containers, nil
+}
+
+// podContainers lists the containers in the Pod cgroup path, except the pause container
+func podContainers(podPath string, podUid string) []containerInfo {
+
+	root := cgroupHierarchy()
+	entries, err := os.ReadDir(root + podPath)
+	if err != nil {
+		return nil
+	}
+
+	var containers []containerInfo
+	for _, e := range entries {
+		id := containerIdRegexp.FindString(e.Name())
+		if !e.IsDir() || id == "" || strings.Contains(e.Name(), "conmon") {
+			continue
+		}
+		c := containerInfo{
+			path:        podPath + "/" + e.Name(),
+			podUid:      strings.ReplaceAll(podUid, "_", "-"),
+			containerId: id,
+			qosClass:    qosClassOf(podPath),
+		}
+		if c.pid = firstProcess(root + c.path); c.pid == 0 {
+			continue
+		}
+		if c.command = commandOf(c.pid); c.command == "pause" {
+			continue
+		}
+		containers = append(containers, c)
+	}
+	return containers
+}
+
+func qosClassOf(path string) string {
+	switch {
+	case strings.Contains(path, "besteffort"):
+		return "BestEffort"
+	case strings.Contains(path, "burstable"):
+		return "Burstable"
+	}
+	return "Guaranteed"
+}
+
+// firstProcess returns the first process in the cgroup directory, 0 if there is none
+func firstProcess(dir string) int {
+	procs, err := os.ReadFile(dir + "/cgroup.procs")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(procs))
+	if len(fields) == 0 {
+		return 0
+	}
+	pid, _ := strconv.Atoi(fields[0])
+	return pid
+}
+
+// commandOf returns the command name of a process, "pause" for the sandbox container holding the namespaces of a Pod
+func commandOf(pid int) string {
+	comm, err := os.ReadFile(procPath(strconv.Itoa(pid), "comm"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(comm))
+}
+
+func runAgent(o *options) error {
+
+	if o.host {
+		setHostMode(o.procRoot, o.cgroupRoot)
+	}
+
+	a := &agent{o: o}
+	switch o.metricType {
+	case "cpu":
+		a.metrics = []metric{cpuMetric}
+	case "mem":
+		a.metrics = []metric{memMetric}
+	default:
+		a.metrics = []metric{cpuMetric, memMetric}
+	}
+
+	if o.listen != "" {
+		a.exporter = newPromExporter(o.window, o.pert)
+		if err := a.exporter.serve(o.listen); err != nil {
+			return err
+		}
+	}
+
+	if strings.HasPrefix(o.out, "file:") {
+		var err error
+		a.file, err = openRotatingFile(output_path+o.out[5:]+"_"+strconv.Itoa(o.span)+"ms_summaries.jsonl",
+			o.daemonConfig.rotateSize, o.daemonConfig.rotateKeep)
+		if err != nil {
+			return err
+		}
+		defer a.file.close()
+	}
+
+	if err := a.rescan(); err != nil {
+		return err
+	}
+	log.Printf("Agent mode: sampling %d containers every %dms, emitting a summary every %s", len(a.targets), o.span, o.daemonConfig.interval)
+
+	interrupt := watchInterrupt()
+	span := time.Duration(o.span) * time.Millisecond
+	timer := time.NewTimer(0)
+	<-timer.C
+
+	start := time.Now()
+	lastScan := start
+	for {
+		t0 := time.Now()
+		if o.duration > 0 && t0.Sub(start) >= o.duration {
+			log.Print("Reached the duration of collection: ", o.duration)
+			break
+		}
+		if t0.Sub(lastScan) >= o.rescan {
+			if err := a.rescan(); err != nil {
+				log.Print("Cannot rescan containers: ", err)
+			}
+			lastScan = t0
+		}
+
+		a.sample(t0)
+
+		timer.Reset(span)
+		select {
+		case <-timer.C:
+			continue
+		case <-interrupt:
+			timer.Stop()
+		}
+		// a signal is the normal end of an agent
+		log.Print("Colibri agent is stopped")
+		break
+	}
+
+	for _, t := range a.targets {
+		a.remove(t)
+	}
+	return nil
+}
+
+// sample reads all containers concurrently, then passes the numbers to their sinks on the loop
+func (a *agent) sample(t time.Time) {
+
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, runtime.NumCPU())
+	for _, target := range a.targets {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(target *agentTarget) {
+			defer wg.Done()
+			target.values, target.err = readAll(target.collectors)
+			<-limit
+		}(target)
+	}
+	wg.Wait()
+
+	alive := a.targets[:0]
+	var gone []*agentTarget
+	for _, target := range a.targets {
+		if target.err != nil {
+			gone = append(gone, target)
+			continue
+		}
+		target.summaries.observe(t, target.values)
+		if target.prom != nil {
+			target.prom.observe(t, target.values)
+		}
+		alive = append(alive, target)
+	}
+	a.targets = alive
+
+	for _, target := range gone {
+		log.Printf("Container %s of Pod %s is gone: %v", shortId(target.info.containerId), target.info.podUid, target.err)
+		a.remove(target)
+	}
+}
+
+// rescan adds the containers newly found, the gone ones are removed once they fail to read
+func (a *agent) rescan() error {
+
+	containers, err := discoverContainers()
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]bool)
+	for _, t := range a.targets {
+		known[t.info.path] = true
+	}
+
+	for _, c := range containers {
+		if known[c.path] {
+			continue
+		}
+		t, err := a.add(c)
+		if err != nil {
+			log.Printf("Cannot sample container %s of Pod %s: %v", shortId(c.containerId), c.podUid, err)
+			continue
+		}
+		log.Printf("Found container %s of Pod %s (%s)", shortId(c.containerId), c.podUid, c.qosClass)
+		a.targets = append(a.targets, t)
+	}
+
+	// keep a stable order for reading
+	sort.Slice(a.targets, func(i, j int) bool { return a.targets[i].info.path < a.targets[j].info.path })
+	return nil
+}
+
+func (a *agent) add(c containerInfo) (*agentTarget, error) {
+
+	t := &agentTarget{info: c}
+	for _, m := range a.metrics {
+		var col collector
+		var err error
+		if m.key == cpuMetric.key {
+			col, err = newCgroupCpuCollectorAt(c.path)
+		} else {
+			col, err = newCgroupMemoryCollectorAt(c.path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		t.collectors = append(t.collectors, col)
+	}
+
+	target := Target{
+		Pid:         c.pid,
+		Source:      "cgroup",
+		PodUid:      c.podUid,
+		ContainerId: c.containerId,
+		QosClass:    c.qosClass,
+		Cgroup:      c.path,
+	}
+	s := Scraper{pid: strconv.Itoa(c.pid), out: a.o.out, ms: a.o.span, pert: a.o.pert, daemon: true,
+		memLimit: readMemoryLimit(memoryLimitPathAt(c.path))}
+
+	t.summaries = newSummarizer(a.o.daemonConfig, a.metrics, summaryEmitter(a.o.name, s, target, nil, a.file, a.o.json))
+	if a.exporter != nil {
+		t.prom = a.exporter.attach(promLabels(a.o.name, target), a.metrics)
+	}
+	return t, nil
+}
+
+// remove emits the last partial window of a container and stops exposing it
+func (a *agent) remove(t *agentTarget) {
+	t.summaries.close()
+	if t.prom != nil {
+		a.exporter.detach(t.prom)
+	}
+}
+
+func shortId(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -0,0 +1,166 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeCgroups writes a cgroup tree of directories with their cgroup.procs, and a /proc of the command names
+func fakeCgroups(t *testing.T, dirs map[string]string, comms map[string]string) {
+	saved, savedProc := CgroupFilesystemDir, ProcDir
+	CgroupFilesystemDir, ProcDir = t.TempDir(), t.TempDir()
+	t.Cleanup(func() { CgroupFilesystemDir, ProcDir = saved, savedProc })
+
+	root := cgroupHierarchy()
+	for dir, procs := range dirs {
+		if err := os.MkdirAll(root+dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root+dir, "cgroup.procs"), []byte(procs), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for pid, comm := range comms {
+		if err := os.MkdirAll(filepath.Join(ProcDir, pid), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(ProcDir, pid, "comm"), []byte(comm+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDiscoverContainers(t *testing.T) {
+
+	app := strings.Repeat("a1", 32)
+	sandbox := strings.Repeat("b2", 32)
+	stopped := strings.Repeat("c3", 32)
+
+	comms := map[string]string{"100": "nginx", "101": "pause", "102": "conmon", "200": "redis"}
+
+	tests := []struct {
+		name string
+		dirs map[string]string
+		want []containerInfo
+	}{
+		{
+			"systemd burstable",
+			map[string]string{
+				"/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod1f4b_0c2e.slice/cri-containerd-" + app + ".scope": "100\n",
+			},
+			[]containerInfo{{
+				"/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod1f4b_0c2e.slice/cri-containerd-" + app + ".scope",
+				"1f4b-0c2e", app, "Burstable", 100, "nginx",
+			}},
+		},
+		{
+			"systemd guaranteed",
+			map[string]string{
+				"/kubepods.slice/kubepods-pod1f4b_0c2e.slice/cri-containerd-" + app + ".scope": "100\n",
+			},
+			[]containerInfo{{
+				"/kubepods.slice/kubepods-pod1f4b_0c2e.slice/cri-containerd-" + app + ".scope",
+				"1f4b-0c2e", app, "Guaranteed", 100, "nginx",
+			}},
+		},
+		{
+			"cgroupfs besteffort",
+			map[string]string{
+				"/kubepods/besteffort/pod1f4b-0c2e/" + app: "100\n101\n",
+			},
+			[]containerInfo{{
+				"/kubepods/besteffort/pod1f4b-0c2e/" + app,
+				"1f4b-0c2e", app, "BestEffort", 100, "nginx",
+			}},
+		},
+		{
+			"cgroupfs guaranteed",
+			map[string]string{
+				"/kubepods/pod1f4b-0c2e/" + app: "100\n",
+			},
+			[]containerInfo{{
+				"/kubepods/pod1f4b-0c2e/" + app,
+				"1f4b-0c2e", app, "Guaranteed", 100, "nginx",
+			}},
+		},
+		{
+			"pause, conmon and stopped containers",
+			map[string]string{
+				"/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod1f4b_0c2e.slice/crio-" + app + ".scope":        "100\n",
+				"/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod1f4b_0c2e.slice/crio-" + sandbox + ".scope":    "101\n",
+				"/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod1f4b_0c2e.slice/crio-conmon-" + app + ".scope": "102\n",
+				"/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod1f4b_0c2e.slice/crio-" + stopped + ".scope":    "",
+			},
+			[]containerInfo{{
+				"/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod1f4b_0c2e.slice/crio-" + app + ".scope",
+				"1f4b-0c2e", app, "BestEffort", 100, "nginx",
+			}},
+		},
+		{
+			"both drivers",
+			map[string]string{
+				"/kubepods.slice/kubepods-pod1f4b_0c2e.slice/cri-containerd-" + app + ".scope": "100\n",
+				"/kubepods/burstable/pod9d8e-7f6a/" + stopped:                                  "200\n",
+				"/kubepods/burstable/pod9d8e-7f6a/" + sandbox:                                  "101\n",
+			},
+			[]containerInfo{
+				{"/kubepods.slice/kubepods-pod1f4b_0c2e.slice/cri-containerd-" + app + ".scope", "1f4b-0c2e", app, "Guaranteed", 100, "nginx"},
+				{"/kubepods/burstable/pod9d8e-7f6a/" + stopped, "9d8e-7f6a", stopped, "Burstable", 200, "redis"},
+			},
+		},
+		{
+			"no kubepods",
+			map[string]string{"/system.slice/nginx.service": "100\n"},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeCgroups(t, tt.dirs, comms)
+			got, err := discoverContainers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("discoverContainers() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQosClassOf(t *testing.T) {
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod1f4b_0c2e.slice", "BestEffort"},
+		{"/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod1f4b_0c2e.slice", "Burstable"},
+		{"/kubepods.slice/kubepods-pod1f4b_0c2e.slice", "Guaranteed"},
+		{"/kubepods/besteffort/pod1f4b-0c2e", "BestEffort"},
+		{"/kubepods/burstable/pod1f4b-0c2e", "Burstable"},
+		{"/kubepods/pod1f4b-0c2e", "Guaranteed"},
+	}
+	for _, tt := range tests {
+		if got := qosClassOf(tt.path); got != tt.want {
+			t.Errorf("qosClassOf(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
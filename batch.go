@@ -0,0 +1,165 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// the batches a queue holds, samples are dropped once it is full
+	queuedBatches = 20
+	// the attempts of writing a batch, with backoff in between
+	batchAttempts = 3
+	// the timeout of writing a batch over HTTP
+	batchTimeout = 10 * time.Second
+)
+
+// batchWriter ships batches of samples to a time-series database
+type batchWriter interface {
+	write(batch []sample) error
+	// close releases the writer once all batches are written
+	close() error
+}
+
+type batchConfig struct {
+	size     int
+	interval time.Duration
+}
+
+func (c batchConfig) validate() error {
+	if c.size <= 0 {
+		return newError(errUsage, "--batch-size must be positive, got %d", c.size)
+	}
+	if c.interval <= 0 {
+		return newError(errUsage, "--batch-interval must be positive, got %s", c.interval)
+	}
+	return nil
+}
+
+// batchSink queues samples for a writer and writes them in batches, of the size or every interval.
+// The sampling loop never waits on it: when the writer falls behind and the queue is full,
+// new samples are dropped and counted rather than slowing down the sampling.
+type batchSink struct {
+	name    string
+	writer  batchWriter
+	config  batchConfig
+	queue   chan sample
+	dropped int64
+	// the error of the last failed batch
+	err  error
+	done chan struct{}
+}
+
+func newBatchSink(name string, writer batchWriter, config batchConfig) *batchSink {
+
+	b := &batchSink{
+		name:   name,
+		writer: writer,
+		config: config,
+		queue:  make(chan sample, config.size*queuedBatches),
+		done:   make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *batchSink) observe(t time.Time, values []float64) {
+	select {
+	case b.queue <- sample{t, append([]float64(nil), values...)}:
+	default:
+		atomic.AddInt64(&b.dropped, 1)
+	}
+}
+
+func (b *batchSink) run() {
+
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.config.interval)
+	defer ticker.Stop()
+
+	batch := make([]sample, 0, b.config.size)
+	for {
+		select {
+		case s, ok := <-b.queue:
+			if !ok {
+				b.flush(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) < b.config.size {
+				continue
+			}
+		case <-ticker.C:
+		}
+		b.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+// flush writes a batch with retries, the batch is given up after all attempts
+func (b *batchSink) flush(batch []sample) {
+
+	if n := atomic.SwapInt64(&b.dropped, 0); n > 0 {
+		log.Printf("Dropped %d samples of %s, the writer falls behind", n, b.name)
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := b.writer.write(batch)
+		if err == nil {
+			b.err = nil
+			return
+		}
+		if attempt == batchAttempts {
+			log.Printf("Giving up %d samples of %s: %v", len(batch), b.name, err)
+			b.err = err
+			return
+		}
+		log.Printf("Cannot write samples of %s, retrying in %s: %v", b.name, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// close writes the queued samples and releases the writer.
+// It must be called once the sampling stops.
+func (b *batchSink) close() error {
+
+	close(b.queue)
+	<-b.done
+
+	if err := b.writer.close(); err != nil && b.err == nil {
+		b.err = err
+	}
+	return b.err
+}
+
+// sampleSeries names the raw samples of a metric by its key and unit, e.g. cpu_seconds for the counter of CPU time,
+// and returns the scale from raw numbers
+func sampleSeries(m metric) (string, float64) {
+	if m.counter {
+		unit, scale := m.total()
+		return m.key + "_" + unit, scale
+	}
+	return m.key + "_" + strings.ReplaceAll(m.unitName, "/s", "_per_second"), m.scale
+}
@@ -0,0 +1,434 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// metric describes one series of numbers reported by a collector
+type metric struct {
+	// The name for standard output
+	label string
+	// The postfix of the raw output file
+	file string
+	// The key of the analytic result sent to API
+	key string
+	// Cumulative counters are analyzed as rates per millisecond
+	counter bool
+	// The unit transformation of the analytic result
+	unit func(float64) string
+	// The unit of numbers in result documents, and the scale from raw numbers (rates per millisecond) to it
+	unitName string
+	scale    float64
+	// The container of the numbers in Pod mode, nil for the target itself
+	container *containerInfo
+	// The target of the numbers when profiling several of them, nil for a single target
+	target *Target
+}
+
+// collector reads the values of one or more metrics with a single pass over the virtual files
+type collector struct {
+	metrics []metric
+	read    func() ([]float64, error)
+}
+
+var (
+	cpuMetric     = metric{"CPU", "cpu", "cpu", true, transCpu, "millicores", 1e6 / cpuUnitsPerSecond, nil, nil}
+	memMetric     = metric{"RAM", "mem", "ram", false, transMemoryUnit, "bytes", 1, nil, nil}
+	ingressMetric = metric{"Ingress", "ig_bytes", "ingress", true, transBandwidthUnit, "bytes/s", 1000, nil, nil}
+	egressMetric  = metric{"Egress", "eg_bytes", "egress", true, transBandwidthUnit, "bytes/s", 1000, nil, nil}
+	readMetric    = metric{"Disk read", "read_bytes", "read", true, transBandwidthUnit, "bytes/s", 1000, nil, nil}
+	writeMetric   = metric{"Disk write", "write_bytes", "write", true, transBandwidthUnit, "bytes/s", 1000, nil, nil}
+)
+
+// total returns the unit of the cumulative numbers of a counter, and the scale from raw numbers to it,
+// e.g. CPU time in seconds. The scale of rates is per millisecond, a thousandth of it is per second.
+func (m metric) total() (string, float64) {
+	switch m.unitName {
+	case "millicores":
+		return "seconds", m.scale / 1e6
+	case "percent":
+		return "seconds", m.scale / 1e5
+	}
+	return strings.TrimSuffix(m.unitName, "/s"), m.scale / 1000
+}
+
+func (s Scraper) newCollectors(metricType string, iface string) ([]collector, error) {
+
+	var ctors []func() (collector, error)
+
+	cpu := s.newCpuCollector
+	mem := s.newMemoryCollector
+	net := func() (collector, error) { return newNetworkCollector(s.pid, iface) }
+	io := func() (collector, error) { return newIoCollector(s.pid), nil }
+
+	switch metricType {
+	case "cpu":
+		ctors = append(ctors, cpu)
+	case "mem":
+		ctors = append(ctors, mem)
+	case "net":
+		ctors = append(ctors, net)
+	case "io":
+		ctors = append(ctors, io)
+	case "all":
+		ctors = append(ctors, cpu, mem, net)
+	default:
+		return nil, newError(errUsage, "metric type %q is not in the handling list", metricType)
+	}
+
+	var collectors []collector
+	for _, ctor := range ctors {
+		c, err := ctor()
+		if err != nil {
+			return nil, err
+		}
+		collectors = append(collectors, c)
+	}
+	return collectors, nil
+}
+
+func (s Scraper) newCpuCollector() (collector, error) {
+	if s.procfs {
+		return newProcCpuCollector(s.pid), nil
+	}
+	return newCgroupCpuCollector(s.pid)
+}
+
+func (s Scraper) newMemoryCollector() (collector, error) {
+	if s.procfs {
+		return newProcMemoryCollector(s.pid), nil
+	}
+	return newCgroupMemoryCollector(s.pid)
+}
+
+// metricsOf lists the metrics of collectors in the order of their values
+func metricsOf(collectors []collector) []metric {
+	var metrics []metric
+	for _, c := range collectors {
+		metrics = append(metrics, c.metrics...)
+	}
+	return metrics
+}
+
+func readAll(collectors []collector) ([]float64, error) {
+	var values []float64
+	for _, c := range collectors {
+		v, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v...)
+	}
+	return values, nil
+}
+
+// sink receives every sample as soon as it is taken, in the order of metrics.
+// It is called on the sampling loop and must not block.
+type sink interface {
+	observe(t time.Time, values []float64)
+}
+
+// eventSink is a sink also told the restarts of the target in follow mode
+type eventSink interface {
+	event(e FollowEvent)
+}
+
+// sliceSink passes a part of the values to a sink, the metrics of one container in Pod mode
+type sliceSink struct {
+	sink
+	offset, n int
+}
+
+func (s sliceSink) observe(t time.Time, values []float64) {
+	s.sink.observe(t, values[s.offset:s.offset+s.n])
+}
+
+// metricGroup is a run of metrics of the same container or target
+type metricGroup struct {
+	container *containerInfo
+	target    *Target
+	offset    int
+	metrics   []metric
+}
+
+// groupMetrics splits metrics by their containers and targets, the numbers of the target itself come first
+func groupMetrics(metrics []metric) []metricGroup {
+	var groups []metricGroup
+	for i, m := range metrics {
+		if n := len(groups); n == 0 || groups[n-1].container != m.container || groups[n-1].target != m.target {
+			groups = append(groups, metricGroup{container: m.container, target: m.target, offset: i})
+		}
+		g := &groups[len(groups)-1]
+		g.metrics = append(g.metrics, m)
+	}
+	return groups
+}
+
+// sample is a copy of the values observed at a time
+type sample struct {
+	t      time.Time
+	values []float64
+}
+
+// capture holds the raw numbers of a collection
+type capture struct {
+	metrics []metric
+	// one series per metric
+	series [][]float64
+	// the duration of every iteration in nanosecond
+	intervals []int64
+	start     time.Time
+	end       time.Time
+	// the restarts and counter resets of the target in follow mode
+	events []FollowEvent
+	// the time of every sample in nanosecond since the epoch, shared by all series
+	times []int64
+}
+
+// slice returns the capture of n metrics from offset
+func (c *capture) slice(offset, n int) *capture {
+	return &capture{c.metrics[offset : offset+n], c.series[offset : offset+n], c.intervals, c.start, c.end, c.events, c.times}
+}
+
+// combine sums the series of every metric across several targets, which are sampled on the same ticks.
+// It returns nil for a single target.
+func (c *capture) combine() *capture {
+
+	if len(c.metrics) == 0 || c.metrics[0].target == nil {
+		return nil
+	}
+
+	combined := &capture{intervals: c.intervals, start: c.start, end: c.end, times: c.times}
+	index := make(map[string]int)
+	for i, m := range c.metrics {
+		j, ok := index[m.key]
+		if !ok {
+			index[m.key] = len(combined.metrics)
+			m.target = nil
+			combined.metrics = append(combined.metrics, m)
+			combined.series = append(combined.series, append([]float64(nil), c.series[i]...))
+			continue
+		}
+		for k, v := range c.series[i] {
+			combined.series[j][k] += v
+		}
+	}
+	return combined
+}
+
+// samples returns the number of samples taken
+func (c *capture) samples() int {
+	if len(c.series) == 0 {
+		return 0
+	}
+	return len(c.series[0])
+}
+
+// collect reads all collectors every s.ms millisecond until one of the stop conditions is met:
+// s.iter samples are taken, s.duration passes, or the target terminates.
+func (s Scraper) collect(collectors []collector) (*capture, error) {
+
+	series := make([][]float64, len(metricsOf(collectors)))
+	var intervals, times []int64
+
+	start := time.Now()
+	timer := time.NewTimer(0)
+	<-timer.C
+
+	//start metrics scraping period
+	for i := 0; i < s.iter; i++ {
+		t0 := time.Now()
+		if s.duration > 0 && t0.Sub(start) >= s.duration {
+			log.Print("Reached the duration of collection: ", s.duration)
+			break
+		}
+		if s.interrupted() {
+			break
+		}
+		if s.finished() || (s.untilExit && !processAlive(s.pid)) {
+			log.Print("Target exited, stopping the collection")
+			break
+		}
+		var values []float64
+		var err error
+		if s.follow != nil {
+			if values, err = s.follow.read(t0); err != nil {
+				return nil, err
+			}
+			s.follow.flush(s.sinks)
+			if values == nil {
+				// a tick without a sample while the target restarts does not count
+				s.sleep(timer)
+				i--
+				continue
+			}
+		} else if values, err = readAll(collectors); err != nil {
+			if s.finished() || (s.untilExit && !processAlive(s.pid)) {
+				// the target exits during reading
+				log.Print("Target exited, stopping the collection")
+				break
+			}
+			if i == 0 {
+				// nothing existed in output, then forcefully stop
+				return nil, readError(s.pid, err)
+			}
+			log.Print("App stopped earlier, starting to print output")
+			break
+		}
+
+		if !s.daemon {
+			for j, v := range values {
+				series[j] = append(series[j], v)
+			}
+			times = append(times, t0.UnixNano())
+		}
+		for _, sk := range s.sinks {
+			sk.observe(t0, values)
+		}
+
+		s.sleep(timer)
+		if !s.daemon {
+			intervals = append(intervals, time.Since(t0).Nanoseconds())
+		}
+	}
+
+	c := &capture{metricsOf(collectors), series, intervals, start, time.Now(), nil, times}
+	if s.follow != nil {
+		c.events = s.follow.events
+	}
+	return c, nil
+}
+
+// finished reports if the target is known to be terminated, e.g. the command of exec mode exits
+func (s Scraper) finished() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// interrupted reports if Colibri is asked to stop by signal
+func (s Scraper) interrupted() bool {
+	select {
+	case <-s.interrupt:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for a timespan, or returns early once the target terminates or Colibri is interrupted
+func (s Scraper) sleep(timer *time.Timer) {
+	timer.Reset(time.Duration(s.ms) * time.Millisecond)
+	select {
+	case <-timer.C:
+	case <-s.done:
+		timer.Stop()
+	case <-s.interrupt:
+		timer.Stop()
+	}
+}
+
+// processAlive checks if the process directory of pid still exists
+func processAlive(pid string) bool {
+	_, err := os.Stat(procPath(pid, "stat"))
+	return err == nil
+}
+
+// writeOutputs stores raw metrics to files prefixed by the path after "file:"
+func (s Scraper) writeOutputs(c *capture) error {
+
+	file_prefix := s.outputPrefix()
+
+	for i, m := range c.metrics {
+		lines := make([]string, len(c.series[i]))
+		for j, v := range c.series[i] {
+			lines[j] = fmt.Sprintf("%.0f", v)
+		}
+		if err := writeOutputFile(file_prefix+"ms_"+m.file, lines); err != nil {
+			return err
+		}
+	}
+
+	lines := make([]string, len(c.intervals))
+	for i, t := range c.intervals {
+		lines[i] = fmt.Sprint(t)
+	}
+	if err := writeOutputFile(file_prefix+"ms_intervals", lines); err != nil {
+		return err
+	}
+
+	lines = make([]string, len(c.times))
+	for i, t := range c.times {
+		lines[i] = fmt.Sprint(t)
+	}
+	return writeOutputFile(file_prefix+"ms_timestamps", lines)
+}
+
+func (s Scraper) outputPrefix() string {
+	return output_path + s.out[5:] + "_" + fmt.Sprint(s.ms)
+}
+
+// printResults logs the average and percentile of every series, of their sums across several targets,
+// the correlations of context mode, and the trends of inventory and memory
+func (s Scraper) printResults(name string, c *capture) {
+
+	results, excluded := s.analyze(c)
+	for i, m := range c.metrics {
+		if trendOnly(m) {
+			continue
+		}
+		printResult(displayName(name, m), m.label, m.unit(results[i][0]), m.unit(results[i][1]), s.pert)
+		printExcluded(displayName(name, m), m.label, excluded[i])
+	}
+
+	if combined := c.combine(); combined != nil {
+		results, excluded = s.analyze(combined)
+		for i, m := range combined.metrics {
+			if trendOnly(m) {
+				continue
+			}
+			printResult(name+"/combined", m.label, m.unit(results[i][0]), m.unit(results[i][1]), s.pert)
+			printExcluded(name+"/combined", m.label, excluded[i])
+		}
+	}
+	printCorrelations(name, correlate(c, s.ms))
+	printTrends(name, trends(c, s.ms))
+	printMemoryTrend(name, memoryTrend(c, s.ms, s.memLimit))
+}
+
+// analyze returns the average and percentile of every series, and the intervals of counters left out
+func (s Scraper) analyze(c *capture) ([][]float64, []int) {
+
+	results := make([][]float64, len(c.metrics))
+	excluded := make([]int, len(c.metrics))
+
+	for i, m := range c.metrics {
+		if m.counter {
+			results[i], excluded[i] = countRate(c.series[i], s.ms, s.pert)
+		} else {
+			results[i] = countValue(c.series[i], s.pert)
+		}
+	}
+	return results, excluded
+}
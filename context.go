@@ -0,0 +1,374 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Context mode, enabled by --context, samples the node and the neighbor containers alongside the target:
+// the CPU and memory of the node, its pressure stall information (PSI), and the CPU of the other containers
+// under kubepods. The stalls of the target, its CPU throttling and PSI, are correlated with the activity of
+// the neighbors, to attribute slowdowns on shared nodes.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/montanaflynn/stats"
+)
+
+var (
+	// jiffies per millisecond to millicores
+	nodeCpuMetric = metric{"Node CPU", "node_cpu", "node_cpu", true,
+		func(v float64) string { return transCpuUnitV2(v * 1e6 / clockTicks) }, "millicores", 1e6 / clockTicks, nil, nil}
+	nodeMemMetric      = metric{"Node RAM", "node_mem", "node_ram", false, transMemoryUnit, "bytes", 1, nil, nil}
+	neighborsCpuMetric = metric{"Neighbors CPU", "neighbors_cpu", "neighbors_cpu", true, transCpu, "millicores", 1e6 / cpuUnitsPerSecond, nil, nil}
+	throttledMetric    = metric{"CPU throttled", "throttled", "throttled", true,
+		transPercent(1e5 / throttledUnitsPerSecond), "percent", 1e5 / throttledUnitsPerSecond, nil, nil}
+)
+
+// the resources of pressure stall information, and their names in the log
+var (
+	pressureResources = []string{"cpu", "memory", "io"}
+	pressureLabels    = map[string]string{"cpu": "CPU", "memory": "Memory", "io": "IO"}
+)
+
+// pressureMetric is the share of time stalled on a resource, the total of PSI is in microsecond
+func pressureMetric(label string, key string) metric {
+	return metric{label + " pressure", key + "_psi", key + "_pressure", true, transPercent(0.1), "percent", 0.1, nil, nil}
+}
+
+// the stalls of the target, and the activity of neighbors, which are correlated
+var (
+	stallKeys    = []string{"throttled", "cpu_pressure", "memory_pressure", "io_pressure"}
+	neighborKeys = []string{"neighbors_cpu", "node_cpu"}
+)
+
+func transPercent(scale float64) func(float64) string {
+	return func(v float64) string {
+		return fmt.Sprintf("%.1f%%", v*scale)
+	}
+}
+
+// newContextCollectors reads the node, the neighbor containers, and the stalls of the target with a cgroup.
+// The numbers missing on the node, e.g. PSI disabled in the kernel, are left out.
+func newContextCollectors(pid string, procfs bool, rescan time.Duration) ([]collector, error) {
+
+	var collectors []collector
+
+	stat := ProcDir + "/stat"
+	if _, err := readNodeCpu(stat); err != nil {
+		return nil, fileError(errTarget, err)
+	}
+	collectors = append(collectors, collector{
+		metrics: []metric{nodeCpuMetric},
+		read: func() ([]float64, error) {
+			v, err := readNodeCpu(stat)
+			return []float64{v}, err
+		},
+	})
+
+	meminfo := ProcDir + "/meminfo"
+	if _, err := readNodeMemory(meminfo); err != nil {
+		return nil, fileError(errTarget, err)
+	}
+	collectors = append(collectors, collector{
+		metrics: []metric{nodeMemMetric},
+		read: func() ([]float64, error) {
+			v, err := readNodeMemory(meminfo)
+			return []float64{v}, err
+		},
+	})
+
+	for _, r := range pressureResources {
+		if c, ok := pressureCollector(ProcDir+"/pressure/"+r, pressureMetric("Node "+pressureLabels[r], "node_"+r)); ok {
+			collectors = append(collectors, c)
+		} else {
+			log.Printf("No pressure stall information of the node for %s, it needs a kernel with PSI enabled", r)
+		}
+	}
+
+	dir := ""
+	if !procfs {
+		var err error
+		if dir, err = getCgroupDirOf(pid); err != nil {
+			return nil, err
+		}
+	}
+	if dir != "" {
+		if c, ok := statCollector(dir+"/cpu.stat", throttledKey, throttledMetric); ok {
+			collectors = append(collectors, c)
+		}
+		// cgroup v2 only
+		for _, r := range pressureResources {
+			if c, ok := pressureCollector(dir+"/"+r+".pressure", pressureMetric(pressureLabels[r], r)); ok {
+				collectors = append(collectors, c)
+			}
+		}
+	} else {
+		log.Print("The target has no cgroup, its stalls are not sampled")
+	}
+
+	neighbors := &neighborCpu{exclude: strings.TrimPrefix(dir, cgroupHierarchy()), rescan: rescan, last: make(map[string]float64)}
+	if err := neighbors.scan(time.Now()); err != nil {
+		return nil, err
+	}
+	log.Printf("Context mode: sampling the node and %d neighbor containers", len(neighbors.containers))
+	collectors = append(collectors, collector{
+		metrics: []metric{neighborsCpuMetric},
+		read: func() ([]float64, error) {
+			return []float64{neighbors.read()}, nil
+		},
+	})
+	return collectors, nil
+}
+
+// readNodeCpu returns the busy time of all CPUs in jiffies, from the first line of /proc/stat
+func readNodeCpu(path string) (float64, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(strings.SplitN(string(content), "\n", 2)[0])
+	if len(fields) < 9 || fields[0] != "cpu" {
+		return 0, fmt.Errorf("malformed %s", path)
+	}
+	// user nice system idle iowait irq softirq steal, without idle and iowait
+	var busy float64
+	for _, i := range []int{1, 2, 3, 6, 7, 8} {
+		busy += stringToFloat(fields[i])
+	}
+	return busy, nil
+}
+
+// readNodeMemory returns the memory in use, MemTotal without MemAvailable
+func readNodeMemory(path string) (float64, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var total, available float64
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = stringToFloat(fields[1]) * 1024
+		case "MemAvailable:":
+			available = stringToFloat(fields[1]) * 1024
+		}
+	}
+	if total == 0 {
+		return 0, fmt.Errorf("malformed %s", path)
+	}
+	return total - available, nil
+}
+
+// pressureCollector reads the total stall time of "some" tasks in a PSI file, false if it does not exist
+func pressureCollector(path string, m metric) (collector, bool) {
+	if _, err := readPressure(path); err != nil {
+		return collector{}, false
+	}
+	return collector{
+		metrics: []metric{m},
+		read: func() ([]float64, error) {
+			v, err := readPressure(path)
+			return []float64{v}, err
+		},
+	}, true
+}
+
+func readPressure(path string) (float64, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	for _, field := range strings.Fields(strings.SplitN(string(content), "\n", 2)[0]) {
+		if strings.HasPrefix(field, "total=") {
+			return stringToFloat(field[len("total="):]), nil
+		}
+	}
+	return 0, fmt.Errorf("malformed %s", path)
+}
+
+// statCollector reads a key of a flat keyed file, e.g. cpu.stat, false if it is not there
+func statCollector(path string, key string, m metric) (collector, bool) {
+	if _, err := readStat(path, key); err != nil {
+		return collector{}, false
+	}
+	return collector{
+		metrics: []metric{m},
+		read: func() ([]float64, error) {
+			v, err := readStat(path, key)
+			return []float64{v}, err
+		},
+	}, true
+}
+
+func readStat(path string, key string) (float64, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == key {
+			return stringToFloat(fields[1]), nil
+		}
+	}
+	return 0, fmt.Errorf("no %s in %s", key, path)
+}
+
+// neighborCpu sums the CPU time of the containers other than the target, as a counter.
+// Containers come and go, so only the increase of containers read on both ticks is added.
+type neighborCpu struct {
+	// the cgroup path of the target
+	exclude    string
+	rescan     time.Duration
+	nextScan   time.Time
+	containers map[string]collector
+	last       map[string]float64
+	total      float64
+}
+
+func (n *neighborCpu) scan(t time.Time) error {
+
+	found, err := discoverContainers()
+	if err != nil {
+		return err
+	}
+	n.nextScan = t.Add(n.rescan)
+	containers := make(map[string]collector)
+	for _, c := range found {
+		if c.path == n.exclude {
+			continue
+		}
+		if col, ok := n.containers[c.path]; ok {
+			containers[c.path] = col
+			continue
+		}
+		if col, err := newCgroupCpuCollectorAt(c.path); err == nil {
+			containers[c.path] = col
+		}
+	}
+	n.containers = containers
+	return nil
+}
+
+func (n *neighborCpu) read() float64 {
+
+	if t := time.Now(); !t.Before(n.nextScan) {
+		if err := n.scan(t); err != nil {
+			log.Print("Cannot rescan neighbor containers: ", err)
+		}
+	}
+
+	for path, c := range n.containers {
+		values, err := c.read()
+		if err != nil {
+			// the container is gone
+			delete(n.containers, path)
+			delete(n.last, path)
+			continue
+		}
+		if last, ok := n.last[path]; ok && values[0] >= last {
+			n.total += values[0] - last
+		}
+		n.last[path] = values[0]
+	}
+	for path := range n.last {
+		if _, ok := n.containers[path]; !ok {
+			delete(n.last, path)
+		}
+	}
+	return n.total
+}
+
+// the share of the highest numbers taken as spikes
+const spikePercentile = 95
+
+// correlate relates every stall of the target with the activity of every neighbor, per interval:
+// their Pearson correlation, and how many stall spikes happen during neighbor spikes.
+// It returns nil without context metrics.
+func correlate(c *capture, ms int) []Correlation {
+
+	series := make(map[string][]float64)
+	// the intervals of counters across resets, left out of both series of a correlation
+	excluded := make(map[string][]bool)
+	for i, m := range c.metrics {
+		if m.container != nil || m.target != nil {
+			continue
+		}
+		// the intervals between samples, for counters and levels alike
+		if m.counter {
+			series[m.key], excluded[m.key] = markRates(c.series[i], ms)
+		} else if len(c.series[i]) > 1 {
+			series[m.key], excluded[m.key] = c.series[i][1:], make([]bool, len(c.series[i])-1)
+		}
+	}
+
+	var correlations []Correlation
+	for _, stall := range stallKeys {
+		for _, key := range neighborKeys {
+			if len(series[stall]) != len(series[key]) {
+				continue
+			}
+			var victim, neighbor []float64
+			for j := range series[stall] {
+				if !excluded[stall][j] && !excluded[key][j] {
+					victim = append(victim, series[stall][j])
+					neighbor = append(neighbor, series[key][j])
+				}
+			}
+			if len(victim) < 2 {
+				continue
+			}
+			r := Correlation{Stall: stall, Neighbor: key}
+			r.Pearson, _ = stats.Pearson(victim, neighbor)
+			r.StallSpikes, r.Coincident = coincidentSpikes(victim, neighbor)
+			correlations = append(correlations, r)
+		}
+	}
+	return correlations
+}
+
+// coincidentSpikes counts the intervals of stall spikes, and those of them also neighbor spikes.
+// A spike is above the percentile of its series, and above zero.
+func coincidentSpikes(victim []float64, neighbor []float64) (int, int) {
+
+	victimLimit, _ := stats.Percentile(victim, spikePercentile)
+	neighborLimit, _ := stats.Percentile(neighbor, spikePercentile)
+
+	spikes, coincident := 0, 0
+	for i, v := range victim {
+		if v <= 0 || v < victimLimit {
+			continue
+		}
+		spikes++
+		if neighbor[i] > 0 && neighbor[i] >= neighborLimit {
+			coincident++
+		}
+	}
+	return spikes, coincident
+}
+
+// printCorrelations logs the correlations of the stalls of the target with neighbors
+func printCorrelations(name string, correlations []Correlation) {
+	for _, r := range correlations {
+		log.Printf("%s -- %s vs %s: correlation %.2f, %d of %d stall spikes during neighbor spikes",
+			name, r.Stall, r.Neighbor, r.Pearson, r.Coincident, r.StallSpikes)
+	}
+}
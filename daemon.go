@@ -0,0 +1,263 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Daemon mode, enabled by --daemon, samples continuously as a long-lived sidecar or DaemonSet.
+// No raw numbers are kept for the whole run; instead a result document summarizes every window of
+// --summary-interval, and is logged, appended to rotated files, and sent to Colibri API.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the windows waiting to be emitted, newer ones are dropped beyond it
+	queuedSummaries = 16
+	// the samples of a window, which bounds the memory
+	maxWindowSamples = 1000000
+)
+
+type daemonConfig struct {
+	interval time.Duration
+	// the rotation of the summaries file
+	rotateSize int64
+	rotateKeep int
+}
+
+func (c daemonConfig) validate(span int) error {
+	if c.interval <= 0 {
+		return newError(errUsage, "--summary-interval must be positive, got %s", c.interval)
+	}
+	if c.interval < time.Duration(span)*time.Millisecond {
+		return newError(errUsage, "--summary-interval must cover a span at least, got %s", c.interval)
+	}
+	if c.interval/(time.Duration(span)*time.Millisecond) > maxWindowSamples {
+		return newError(errUsage, "--summary-interval holds more than %d samples of %dms", maxWindowSamples, span)
+	}
+	if c.rotateSize <= 0 {
+		return newError(errUsage, "--rotate-size must be positive, got %d", c.rotateSize)
+	}
+	if c.rotateKeep < 0 {
+		return newError(errUsage, "--rotate-keep cannot be negative, got %d", c.rotateKeep)
+	}
+	return nil
+}
+
+// summarizer is the sink collecting the samples of the current window
+type summarizer struct {
+	config  daemonConfig
+	metrics []metric
+	window  *capture
+	// the finished windows for the emitter
+	queue chan *capture
+	emit  func(c *capture)
+	done  chan struct{}
+	// the events for the window of the next sample
+	events []FollowEvent
+}
+
+func newSummarizer(config daemonConfig, metrics []metric, emit func(c *capture)) *summarizer {
+
+	s := &summarizer{
+		config:  config,
+		metrics: metrics,
+		queue:   make(chan *capture, queuedSummaries),
+		emit:    emit,
+		done:    make(chan struct{}),
+	}
+
+	// emitting calls the API with retries, which must not hold up the sampling
+	go func() {
+		defer close(s.done)
+		for c := range s.queue {
+			s.emit(c)
+		}
+	}()
+	return s
+}
+
+func (s *summarizer) observe(t time.Time, values []float64) {
+
+	if s.window != nil && t.Sub(s.window.start) >= s.config.interval {
+		s.window.end = t
+		s.finish()
+	}
+	if s.window == nil {
+		s.window = &capture{metrics: s.metrics, series: make([][]float64, len(s.metrics)), start: t}
+	}
+	s.window.events = append(s.window.events, s.events...)
+	s.events = nil
+	for i, v := range values {
+		s.window.series[i] = append(s.window.series[i], v)
+	}
+}
+
+func (s *summarizer) event(e FollowEvent) {
+	s.events = append(s.events, e)
+}
+
+func (s *summarizer) finish() {
+	select {
+	case s.queue <- s.window:
+	default:
+		log.Printf("Dropped the summary of the window from %s, emitting falls behind", s.window.start.Format(time.RFC3339))
+	}
+	s.window = nil
+}
+
+// close emits the partial window, once the sampling stops
+func (s *summarizer) close() {
+	if s.window != nil {
+		s.window.end = time.Now()
+		s.finish()
+	}
+	close(s.queue)
+	<-s.done
+}
+
+// summaryEmitter returns the emitter of window summaries: to the log, to file and API by s.out, and to stdout with --json
+func summaryEmitter(name string, s Scraper, target Target, api *apiClient, file *rotatingFile, printJSON bool) func(c *capture) {
+
+	// tell the containers apart in the log of agent mode
+	logName := name
+	if target.ContainerId != "" {
+		logName = name + "/" + shortId(target.ContainerId)
+	}
+
+	return func(c *capture) {
+
+		s.printResults(logName, c)
+
+		r := newResult(name, s, target, c)
+		if s.tasks != nil {
+			r.Processes, r.Threads = s.tasks.take(c.end)
+			printTasks(logName, r.Processes, r.Threads)
+		}
+		// a window is complete even if the daemon is stopping
+		r.Interrupted = false
+		doc, err := json.Marshal(r)
+		if err != nil {
+			log.Print("Cannot encode the summary: ", err)
+			return
+		}
+
+		if printJSON {
+			os.Stdout.Write(append(doc, '\n'))
+		}
+		if file != nil {
+			if err = file.writeLine(doc); err != nil {
+				log.Print("Cannot write the summary: ", err)
+			}
+		}
+		if api != nil {
+			if err = api.send(doc, strings.TrimPrefix(s.out, "api:")); err != nil {
+				log.Print("Cannot send the summary: ", err)
+			}
+		}
+	}
+}
+
+// rotatingFile appends lines to a file, which is rotated once it exceeds the size:
+// <path> is renamed to <path>.1, <path>.1 to <path>.2, and so on up to <path>.<keep>.
+type rotatingFile struct {
+	path string
+	size int64
+	keep int
+
+	// the emitters of containers share a file in agent mode
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	written int64
+}
+
+func openRotatingFile(path string, size int64, keep int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, size: size, keep: keep}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fileError(errOutput, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fileError(errOutput, err)
+	}
+
+	r.f, r.w, r.written = f, bufio.NewWriter(f), info.Size()
+	return nil
+}
+
+func (r *rotatingFile) writeLine(line []byte) error {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.written > 0 && r.written+int64(len(line))+1 > r.size {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+
+	r.w.Write(line)
+	r.w.WriteByte('\n')
+	r.written += int64(len(line)) + 1
+	// every line is a complete summary, flush it for readers of the file
+	if err := r.w.Flush(); err != nil {
+		return fileError(errOutput, err)
+	}
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+
+	if err := r.f.Close(); err != nil {
+		return fileError(errOutput, err)
+	}
+
+	if r.keep == 0 {
+		os.Remove(r.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", r.path, r.keep))
+		for i := r.keep - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return fileError(errOutput, err)
+		}
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) close() error {
+	if err := r.f.Close(); err != nil {
+		return fileError(errOutput, err)
+	}
+	return nil
+}
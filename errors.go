@@ -0,0 +1,136 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+)
+
+// errorKind classifies failures of Colibri, every kind has its own exit code
+type errorKind int
+
+// The exit codes are documented in README, keep them in sync
+const (
+	errInternal    errorKind = 1
+	errUsage       errorKind = 2
+	errInterrupted errorKind = exitInterrupted
+	errTarget      errorKind = 4
+	errCgroup      errorKind = 5
+	errPermission  errorKind = 6
+	errApi         errorKind = 7
+	errOutput      errorKind = 8
+)
+
+func (k errorKind) String() string {
+	switch k {
+	case errUsage:
+		return "invalid flags"
+	case errInterrupted:
+		return "interrupted"
+	case errTarget:
+		return "target not found"
+	case errCgroup:
+		return "cgroup path missing"
+	case errPermission:
+		return "permission denied"
+	case errApi:
+		return "API failure"
+	case errOutput:
+		return "output failure"
+	}
+	return "internal error"
+}
+
+// Error is a failure of Colibri with its kind
+type Error struct {
+	Kind errorKind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Kind.String() + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newError(kind errorKind, format string, a ...interface{}) error {
+	return &Error{kind, fmt.Errorf(format, a...)}
+}
+
+// fileError classifies a failure of file access as kind, or as permission denied if it is the case
+func fileError(kind errorKind, err error) error {
+	if errors.Is(err, fs.ErrPermission) {
+		return &Error{errPermission, err}
+	}
+	return &Error{kind, err}
+}
+
+// readError classifies a failure of reading the virtual files of a target:
+// a missing file means the target is gone, unless its process still exists.
+func readError(pid string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) && processAlive(pid) {
+		return &Error{errCgroup, err}
+	}
+	return fileError(errTarget, err)
+}
+
+// commandExit carries the exit code of the command in exec mode
+type commandExit int
+
+func (c commandExit) Error() string {
+	return fmt.Sprintf("command exits with code %d", int(c))
+}
+
+// exitExecFailure is the exit code of any failure of Colibri in exec mode. The codes of Colibri would pass for
+// exit codes of the command there, so like timeout(1) and env(1) it takes 125, which shells do not give.
+const exitExecFailure = 125
+
+// execExitCode maps the error of exec mode to the exit code of the command, or to exitExecFailure
+func execExitCode(err error) int {
+
+	var code commandExit
+	if errors.As(err, &code) {
+		return int(code)
+	}
+	exitCode(err)
+	return exitExecFailure
+}
+
+// exitCode logs the error and maps it to the exit code of Colibri
+func exitCode(err error) int {
+
+	var code commandExit
+	if errors.As(err, &code) {
+		return int(code)
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		if e.Kind == errInterrupted {
+			log.Print("Colibri is interrupted, partial results are flushed")
+		} else {
+			log.Print("Error: ", e)
+		}
+		return int(e.Kind)
+	}
+
+	log.Print("Error: ", err)
+	return int(errInternal)
+}
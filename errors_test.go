@@ -0,0 +1,47 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		err        error
+		code, exec int
+	}{
+		{"usage", newError(errUsage, "bad flag"), 2, exitExecFailure},
+		{"target", newError(errTarget, "no process"), 4, exitExecFailure},
+		{"wrapped", fmt.Errorf("reading: %w", newError(errCgroup, "no cgroup")), 5, exitExecFailure},
+		{"unclassified", errors.New("boom"), 1, exitExecFailure},
+		{"command", commandExit(2), 2, 2},
+		{"command killed", commandExit(137), 137, 137},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.code {
+				t.Errorf("exitCode() = %d, want %d", got, tt.code)
+			}
+			if got := execExitCode(tt.err); got != tt.exec {
+				t.Errorf("execExitCode() = %d, want %d", got, tt.exec)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Exec mode, "colibri run [flags] -- <cmd> args...", launches a command and profiles it,
+// together with its descendants, for its whole lifetime.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+)
+
+// child is a command launched by Colibri
+type child struct {
+	cmd *exec.Cmd
+	// closed once the command exits and is reaped
+	done chan struct{}
+	err  error
+}
+
+// forwardedSignals are relayed to the command instead of stopping Colibri
+var forwardedSignals = []os.Signal{
+	syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2,
+}
+
+func startCommand(args []string) (*child, error) {
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// subscribe before starting, so no signal is missed in between
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, forwardedSignals...)
+
+	if err := cmd.Start(); err != nil {
+		signal.Stop(sigs)
+		return nil, fileError(errTarget, fmt.Errorf("cannot start the command: %w", err))
+	}
+	log.Printf("Started command %q with process ID %d", args[0], cmd.Process.Pid)
+
+	c := &child{cmd: cmd, done: make(chan struct{})}
+
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				log.Print("Forwarding signal to the command: ", sig)
+				cmd.Process.Signal(sig)
+			case <-c.done:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		c.err = cmd.Wait()
+		signal.Stop(sigs)
+		close(c.done)
+	}()
+
+	return c, nil
+}
+
+func (c *child) pid() string {
+	return strconv.Itoa(c.cmd.Process.Pid)
+}
+
+// exitCode returns the exit code of the command, following the shell convention 128+n for signal n
+func (c *child) exitCode() int {
+
+	<-c.done
+
+	var exitErr *exec.ExitError
+	if c.err != nil && !errors.As(c.err, &exitErr) {
+		log.Print("Command failed: ", c.err)
+		return 1
+	}
+
+	state := c.cmd.ProcessState
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		log.Print("Command is killed by signal: ", status.Signal())
+		return 128 + int(status.Signal())
+	}
+	log.Print("Command exits with code ", state.ExitCode())
+	return state.ExitCode()
+}
@@ -0,0 +1,279 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Follow mode, enabled by --follow, identifies the target by its container or cgroup instead of a process ID,
+// and keeps profiling it across restarts: once the process is gone, Colibri waits for the process replacing it,
+// in the same cgroup or in a new container of the same Pod running the same command, and reattaches to it.
+// Counters of the new process start over, they are rebased on the last numbers so rates never turn negative.
+
+import (
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// followSelector identifies the target of follow mode
+type followSelector struct {
+	// container or cgroup
+	kind string
+	// the container ID or its prefix, or the cgroup path relative to the hierarchy
+	value string
+}
+
+func parseFollowSelector(s string) (followSelector, error) {
+	kind, value, _ := strings.Cut(s, ":")
+	if (kind != "container" && kind != "cgroup") || value == "" {
+		return followSelector{}, newError(errUsage, "--follow must be container:<ID> or cgroup:<path>, got %q", s)
+	}
+	if kind == "cgroup" {
+		value = "/" + strings.Trim(value, "/")
+	}
+	return followSelector{kind, value}, nil
+}
+
+func (s followSelector) String() string {
+	return s.kind + " " + s.value
+}
+
+// follower reads the target of follow mode, and reattaches to it after restarts
+type follower struct {
+	selector          followSelector
+	timeout           time.Duration
+	metricType, iface string
+
+	pid        string
+	collectors []collector
+	metrics    []metric
+	// the container followed, its Pod and command tell the container re-created by a restart
+	container *containerInfo
+	// the containers of the Pod known before, which are not a restart
+	seen map[string]bool
+	// when the process is found gone
+	lostSince time.Time
+
+	// the last numbers, and the offsets added to the counters reset
+	last, base []float64
+	// the events not yet passed to sinks, and all of them
+	pending, events []FollowEvent
+}
+
+func newFollower(selector followSelector, timeout time.Duration, metricType string, iface string) *follower {
+	return &follower{selector: selector, timeout: timeout, metricType: metricType, iface: iface, seen: make(map[string]bool)}
+}
+
+// build reads cpu and memory from the cgroup followed, and the others from the current process
+func (f *follower) build(pid string) ([]collector, error) {
+
+	cgroup := f.cgroup()
+	cpu := func() (collector, error) { return newCgroupCpuCollectorAt(cgroup) }
+	mem := func() (collector, error) { return newCgroupMemoryCollectorAt(cgroup) }
+	net := func() (collector, error) { return newNetworkCollector(pid, f.iface) }
+	io := func() (collector, error) { return newIoCollector(pid), nil }
+
+	var ctors []func() (collector, error)
+	switch f.metricType {
+	case "cpu":
+		ctors = append(ctors, cpu)
+	case "mem":
+		ctors = append(ctors, mem)
+	case "net":
+		ctors = append(ctors, net)
+	case "io":
+		ctors = append(ctors, io)
+	case "all":
+		ctors = append(ctors, cpu, mem, net)
+	}
+
+	var collectors []collector
+	for _, ctor := range ctors {
+		c, err := ctor()
+		if err != nil {
+			return nil, err
+		}
+		collectors = append(collectors, c)
+	}
+	return collectors, nil
+}
+
+// cgroup returns the cgroup path followed, relative to the hierarchy
+func (f *follower) cgroup() string {
+	if f.container != nil {
+		return f.container.path
+	}
+	return f.selector.value
+}
+
+// attach finds the process of the target and builds its collectors, before sampling starts
+func (f *follower) attach() (string, error) {
+
+	pid, err := f.find()
+	if err != nil {
+		return "", err
+	}
+	if pid == "" {
+		return "", newError(errTarget, "no process is found for %s", f.selector)
+	}
+	if f.collectors, err = f.build(pid); err != nil {
+		return "", err
+	}
+	f.pid, f.metrics = pid, metricsOf(f.collectors)
+	f.base = make([]float64, len(f.metrics))
+	return pid, nil
+}
+
+// find returns the current process of the target, empty if there is none yet
+func (f *follower) find() (string, error) {
+
+	root := cgroupHierarchy()
+	if f.selector.kind == "cgroup" {
+		if pid := firstProcess(root + f.selector.value); pid != 0 {
+			return strconv.Itoa(pid), nil
+		}
+		return "", nil
+	}
+
+	if f.container == nil {
+		containers, err := discoverContainers()
+		if err != nil {
+			return "", err
+		}
+		for i, c := range containers {
+			if strings.HasPrefix(c.containerId, f.selector.value) {
+				f.container = &containers[i]
+				break
+			}
+		}
+		if f.container == nil {
+			return "", nil
+		}
+		for _, c := range podContainers(path.Dir(f.container.path), f.container.podUid) {
+			f.seen[c.containerId] = true
+		}
+		return strconv.Itoa(f.container.pid), nil
+	}
+
+	// a new process in the same container, or a new container replacing it
+	if pid := firstProcess(root + f.container.path); pid != 0 {
+		return strconv.Itoa(pid), nil
+	}
+	for _, c := range podContainers(path.Dir(f.container.path), f.container.podUid) {
+		if f.seen[c.containerId] || c.command != f.container.command {
+			continue
+		}
+		log.Printf("Container %s is replaced by container %s", shortId(f.container.containerId), shortId(c.containerId))
+		f.seen[c.containerId] = true
+		c := c
+		f.container = &c
+		return strconv.Itoa(c.pid), nil
+	}
+	return "", nil
+}
+
+// read returns the numbers of the target, or nil while waiting for it to restart.
+// It fails once the target is not back in the timeout.
+func (f *follower) read(t time.Time) ([]float64, error) {
+
+	if f.collectors != nil {
+		values, err := readAll(f.collectors)
+		if err == nil && processAlive(f.pid) {
+			return f.rebase(t, values), nil
+		}
+		log.Printf("Process %s of %s is gone, waiting for it to restart", f.pid, f.selector)
+		f.collectors, f.lostSince = nil, t
+	}
+
+	pid, err := f.find()
+	if err != nil {
+		return nil, err
+	}
+	if pid != "" && processAlive(pid) {
+		// the collectors cannot be built while the new process is starting, try again on the next tick
+		if collectors, err := f.build(pid); err == nil {
+			if values, err := readAll(collectors); err == nil {
+				return f.reattach(t, pid, collectors, values)
+			}
+		}
+	}
+
+	if t.Sub(f.lostSince) >= f.timeout {
+		return nil, newError(errTarget, "%s is not back in %s", f.selector, f.timeout)
+	}
+	return nil, nil
+}
+
+// reattach takes the collectors of the restarted process, which must read the same metrics in the same order as before
+func (f *follower) reattach(t time.Time, pid string, collectors []collector, values []float64) ([]float64, error) {
+
+	metrics := metricsOf(collectors)
+	same := len(values) == len(f.metrics) && len(metrics) == len(f.metrics)
+	for j := 0; same && j < len(metrics); j++ {
+		same = metrics[j].key == f.metrics[j].key
+	}
+	if !same {
+		return nil, newError(errTarget, "%s restarted as process %s with other metrics than before", f.selector, pid)
+	}
+
+	log.Printf("%s restarted as process %s", f.selector, pid)
+	f.pid, f.collectors = pid, collectors
+	n, _ := strconv.Atoi(pid)
+	f.event(FollowEvent{Time: t.UTC(), Kind: "restart", Pid: n})
+	return f.rebase(t, values), nil
+}
+
+// rebase continues the counters reset by a restart from their last numbers, the interval across it reads no increase
+func (f *follower) rebase(t time.Time, values []float64) []float64 {
+
+	var reset []string
+	for j, m := range f.metrics {
+		if !m.counter {
+			continue
+		}
+		v := values[j] + f.base[j]
+		if f.last != nil && v < f.last[j] {
+			f.base[j] += f.last[j] - v
+			v = f.last[j]
+			reset = append(reset, m.key)
+		}
+		values[j] = v
+	}
+
+	if reset != nil {
+		log.Printf("Counters of %s are reset: %s", f.selector, strings.Join(reset, ", "))
+		n, _ := strconv.Atoi(f.pid)
+		f.event(FollowEvent{Time: t.UTC(), Kind: "counterReset", Pid: n, Metrics: reset})
+	}
+	f.last = values
+	return values
+}
+
+func (f *follower) event(e FollowEvent) {
+	f.pending = append(f.pending, e)
+	f.events = append(f.events, e)
+}
+
+// flush passes the new events to the sinks taking them
+func (f *follower) flush(sinks []sink) {
+	for _, e := range f.pending {
+		for _, sk := range sinks {
+			if es, ok := sk.(eventSink); ok {
+				es.event(e)
+			}
+		}
+	}
+	f.pending = nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFollowerRebase(t *testing.T) {
+
+	f := newFollower(followSelector{"cgroup", "/app"}, time.Minute, "all", "")
+	f.pid, f.metrics = "10", []metric{cpuMetric, memMetric, egressMetric}
+	f.base = make([]float64, len(f.metrics))
+	start := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	tick := func(i int) time.Time { return start.Add(time.Duration(i) * time.Second) }
+
+	f.rebase(tick(0), []float64{100, 500, 1000})
+	if got := f.rebase(tick(1), []float64{150, 600, 1200}); !reflect.DeepEqual(got, []float64{150, 600, 1200}) {
+		t.Errorf("rebase() = %v, want the numbers read", got)
+	}
+
+	// the counters of the new process start over, the gauge does not
+	same := []collector{{metrics: []metric{cpuMetric, memMetric}}, {metrics: []metric{egressMetric}}}
+	got, err := f.reattach(tick(2), "20", same, []float64{10, 300, 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []float64{150, 300, 1200}; !reflect.DeepEqual(got, want) {
+		t.Errorf("reattach() = %v, want %v", got, want)
+	}
+	if got := f.rebase(tick(3), []float64{30, 310, 100}); !reflect.DeepEqual(got, []float64{170, 310, 1250}) {
+		t.Errorf("rebase() after the reset = %v, want [170 310 1250]", got)
+	}
+	events := []FollowEvent{
+		{Time: tick(2), Kind: "restart", Pid: 20},
+		{Time: tick(2), Kind: "counterReset", Pid: 20, Metrics: []string{"cpu", "egress"}},
+	}
+	if !reflect.DeepEqual(f.events, events) {
+		t.Errorf("events %+v, want %+v", f.events, events)
+	}
+
+	// the numbers of another order or count would land in the wrong series
+	tests := []struct {
+		name       string
+		collectors []collector
+		values     []float64
+	}{
+		{"other order", []collector{{metrics: []metric{memMetric, cpuMetric, egressMetric}}}, []float64{1, 2, 3}},
+		{"missing metric", []collector{{metrics: []metric{cpuMetric, memMetric}}}, []float64{1, 2}},
+		{"more values", same, []float64{1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		if _, err := f.reattach(tick(4), "30", tt.collectors, tt.values); err == nil || exitCode(err) != int(errTarget) {
+			t.Errorf("%s: reattach() error = %v, want a target error", tt.name, err)
+		}
+		if f.pid != "20" || len(f.collectors) != 2 {
+			t.Errorf("%s: reattach() took process %s", tt.name, f.pid)
+		}
+	}
+}
@@ -3,6 +3,7 @@ module colibri
 go 1.18
 
 require (
+	github.com/golang/snappy v0.0.4
 	github.com/montanaflynn/stats v0.6.6
 	golang.org/x/sys v0.13.0
 )
@@ -0,0 +1,220 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Host mode profiles any process on the machine instead of a container under the kubepods hierarchy.
+// If the process has no dedicated cgroup, e.g. it stays in the root cgroup or shares a systemd
+// slice with other processes, the numbers come from procfs and are summed over its process tree.
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// USER_HZ, the unit of the CPU times in /proc/stat and /proc/<pid>/stat, which is fixed to 100 on Linux
+const clockTicks = 100
+
+var hostMode bool
+
+func setHostMode(procRoot string, cgroupRoot string) {
+	hostMode = true
+	ProcDir = strings.TrimSuffix(procRoot, "/")
+	CgroupFilesystemDir = strings.TrimSuffix(cgroupRoot, "/")
+}
+
+// resolvePid turns "self" into the process ID of Colibri, for running self-tests
+func resolvePid(pid string) string {
+	if hostMode && pid == "self" {
+		return strconv.Itoa(os.Getpid())
+	}
+	return pid
+}
+
+// useProcfs decides if the process is measured through procfs rather than cgroup.
+// It is the case when the cgroup of the process also holds processes out of its process tree.
+func useProcfs(pid string) (bool, error) {
+
+	if !hostMode {
+		return false, nil
+	}
+
+	dir, err := getCgroupDirOf(pid)
+	if err != nil {
+		return false, err
+	}
+	if dir == "" {
+		log.Printf("Process %s stays in the root cgroup, falling back to procfs", pid)
+		return true, nil
+	}
+
+	procs, err := os.ReadFile(dir + "/cgroup.procs")
+	if err != nil {
+		log.Print("Cannot read processes of cgroup, falling back to procfs: ", err)
+		return true, nil
+	}
+
+	tree := make(map[string]bool)
+	for _, p := range processTree(pid) {
+		tree[p] = true
+	}
+
+	for _, p := range strings.Fields(string(procs)) {
+		if !tree[p] {
+			log.Printf("Process %s shares cgroup %s with others, falling back to procfs", pid, dir)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// processTree lists the process and all its descendants, the process itself comes first
+func processTree(pid string) []string {
+
+	tree := []string{pid}
+
+	for i := 0; i < len(tree); i++ {
+		children, _ := filepath.Glob(procPath(tree[i], "task/*/children"))
+		for _, c := range children {
+			content, err := os.ReadFile(c)
+			if err != nil {
+				continue
+			}
+			tree = append(tree, strings.Fields(string(content))...)
+		}
+	}
+	return tree
+}
+
+// sumProcessTree adds up the values read from every process of the tree.
+// Descendants may exit while being read, only failures on the process itself count.
+func sumProcessTree(pid string, read func(p string) ([]float64, error)) ([]float64, error) {
+
+	var sum []float64
+
+	for i, p := range processTree(pid) {
+		values, err := read(p)
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			continue
+		}
+		if sum == nil {
+			sum = make([]float64, len(values))
+		}
+		for j, v := range values {
+			sum[j] += v
+		}
+	}
+	return sum, nil
+}
+
+// getProcCpuValue returns utime, stime and the times of waited-for children in cgroup's CPU unit.
+// Counting the children keeps the sum increasing when a descendant exits.
+func getProcCpuValue(pid string) ([]float64, error) {
+
+	stat, err := os.ReadFile(procPath(pid, "stat"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read stat file of process: %w", err)
+	}
+
+	// the command name may contain spaces, so start after its closing parenthesis with field 3
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	if len(fields) < 15 {
+		return nil, fmt.Errorf("unexpected format of %s", procPath(pid, "stat"))
+	}
+
+	var ticks float64
+	// utime, stime, cutime, cstime are fields 14 to 17
+	for _, f := range fields[11:15] {
+		ticks += stringToFloat(f)
+	}
+	return []float64{ticks * cpuUnitsPerSecond / clockTicks}, nil
+}
+
+// getProcMemoryValue returns the resident set size in bytes
+func getProcMemoryValue(pid string) ([]float64, error) {
+
+	status, err := os.ReadFile(procPath(pid, "status"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read status file of process: %w", err)
+	}
+
+	// kernel threads have no VmRSS
+	idx := findIndex(string(status), "VmRSS:")
+	if idx < 0 {
+		return []float64{0}, nil
+	}
+	kb := strings.Fields(strings.Split(string(status), "\n")[idx])[1]
+
+	return []float64{stringToFloat(kb) * 1024}, nil
+}
+
+// getProcIoValue returns the bytes read from and written to the storage layer
+func getProcIoValue(pid string) ([]float64, error) {
+
+	io, err := os.ReadFile(procPath(pid, "io"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read io file of process: %w", err)
+	}
+
+	var read_bytes, write_bytes float64
+	for _, line := range strings.Split(string(io), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "read_bytes:":
+			read_bytes = stringToFloat(fields[1])
+		case "write_bytes:":
+			write_bytes = stringToFloat(fields[1])
+		}
+	}
+	return []float64{read_bytes, write_bytes}, nil
+}
+
+func newProcCpuCollector(pid string) collector {
+	return collector{
+		metrics: []metric{cpuMetric},
+		read: func() ([]float64, error) {
+			return sumProcessTree(pid, getProcCpuValue)
+		},
+	}
+}
+
+func newProcMemoryCollector(pid string) collector {
+	return collector{
+		metrics: []metric{memMetric},
+		read: func() ([]float64, error) {
+			return sumProcessTree(pid, getProcMemoryValue)
+		},
+	}
+}
+
+// newIoCollector reads procfs in every mode, since cgroup has no per-container counterpart for both versions
+func newIoCollector(pid string) collector {
+	return collector{
+		metrics: []metric{readMetric, writeMetric},
+		read: func() ([]float64, error) {
+			return sumProcessTree(pid, getProcIoValue)
+		},
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The InfluxDB writer, enabled by --influx, ships every sample in line protocol, e.g.
+//   colibri,name=birdy,node=gabbro,pid=1234 cpu_seconds=12.5,ram_bytes=1445888 1727856000000000000
+// to a write endpoint of InfluxDB, or appends it to a file with "file:<path>".
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const influxMeasurement = "colibri"
+
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+type influxWriter struct {
+	// the rendered measurement and tags of every line
+	prefix  string
+	metrics []metric
+
+	// either an HTTP write endpoint, or a file
+	url    string
+	token  string
+	client *http.Client
+	file   *os.File
+}
+
+// newInfluxWriter writes to dest, a write URL like http://localhost:8086/api/v2/write?org=o&bucket=b, or file:<path>
+func newInfluxWriter(dest, tokenFile string, timeout time.Duration, labels [][2]string, metrics []metric) (*influxWriter, error) {
+
+	// tags sorted by key are faster to ingest
+	sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+	prefix := influxMeasurement
+	for _, l := range labels {
+		prefix += "," + influxEscaper.Replace(l[0]) + "=" + influxEscaper.Replace(l[1])
+	}
+	w := &influxWriter{prefix: prefix, metrics: metrics}
+
+	if strings.HasPrefix(dest, "file:") {
+		f, err := os.OpenFile(dest[5:], os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fileError(errOutput, err)
+		}
+		w.file = f
+		return w, nil
+	}
+
+	if tokenFile != "" {
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fileError(errUsage, err)
+		}
+		w.token = strings.TrimSpace(string(token))
+	}
+	w.url = dest
+	w.client = &http.Client{Timeout: timeout}
+	return w, nil
+}
+
+func (w *influxWriter) write(batch []sample) error {
+
+	var buf bytes.Buffer
+	for _, s := range batch {
+		buf.WriteString(w.prefix)
+		for i, m := range w.metrics {
+			name, scale := sampleSeries(m)
+			if i == 0 {
+				buf.WriteByte(' ')
+			} else {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(name + "=" + strconv.FormatFloat(s.values[i]*scale, 'f', -1, 64))
+		}
+		buf.WriteString(" " + strconv.FormatInt(s.t.UnixNano(), 10) + "\n")
+	}
+
+	if w.file != nil {
+		if _, err := w.file.Write(buf.Bytes()); err != nil {
+			return fileError(errOutput, err)
+		}
+		return nil
+	}
+
+	req, err := http.NewRequest("POST", w.url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("InfluxDB responds %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+func (w *influxWriter) close() error {
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			return fileError(errOutput, err)
+		}
+	}
+	return nil
+}
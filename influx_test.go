@@ -0,0 +1,85 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInfluxFile(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "samples.lp")
+	labels := [][2]string{{"node", "gabbro"}, {"name", "my app,v=2"}, {"pod key", "a=b c"}}
+	w, err := newInfluxWriter("file:"+path, "", time.Second, labels, []metric{memMetric, egressMetric})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := []sample{
+		{time.Unix(1, 5), []float64{1024, 0}},
+		{time.Unix(2, 0), []float64{2048, 1500}},
+	}
+	if err = w.write(batch); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// tags sorted by key, with commas, equal signs and spaces escaped in keys and values
+	want := `colibri,name=my\ app\,v\=2,node=gabbro,pod\ key=a\=b\ c ram_bytes=1024,egress_bytes=0 1000000005` + "\n" +
+		`colibri,name=my\ app\,v\=2,node=gabbro,pod\ key=a\=b\ c ram_bytes=2048,egress_bytes=1500 2000000000` + "\n"
+	if string(content) != want {
+		t.Errorf("lines =\n%s\nwant\n%s", content, want)
+	}
+}
+
+func TestInfluxHttp(t *testing.T) {
+
+	var body, auth, contentType string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, _ := io.ReadAll(r.Body)
+		body, auth, contentType = string(content), r.Header.Get("Authorization"), r.Header.Get("Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	w, err := newInfluxWriter(srv.URL+"/api/v2/write?org=o&bucket=b", tokenFile, time.Second, [][2]string{{"node", "gabbro"}}, []metric{memMetric})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.write([]sample{{time.Unix(1, 0), []float64{1024}}}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "colibri,node=gabbro ram_bytes=1024 1000000000\n"; body != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+	if auth != "Token secret" || contentType != "text/plain; charset=utf-8" {
+		t.Errorf("headers Authorization %q and Content-Type %q, want the token and plain text", auth, contentType)
+	}
+}
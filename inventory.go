@@ -0,0 +1,275 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The inventory collector, enabled by --inventory, counts what a container can leak: its open file descriptors
+// and sockets from /proc/<pid>/fd, the TCP sockets of its network namespace by state from /proc/<pid>/net/tcp{,6},
+// and the tasks of its cgroup from pids.current against pids.max. Counting is slower than reading a counter,
+// so it is done off the tick of sampling, by its own goroutine at the coarser interval given by --inventory,
+// and the samples repeat the last numbers counted. The numbers are reported by their growth over the run only,
+// as their averages and percentiles over the repeated samples would tell nothing.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	fdsMetric     = countMetric("Open files", "fds")
+	socketsMetric = countMetric("Sockets", "sockets")
+	pidsMetric    = countMetric("Tasks", "pids_current")
+	pidsMaxMetric = countMetric("Tasks limit", "pids_max")
+)
+
+// the states of TCP sockets in net/tcp, in the order of their numbers from 01
+var tcpStates = []string{"established", "syn_sent", "syn_recv", "fin_wait1", "fin_wait2", "time_wait",
+	"close", "close_wait", "last_ack", "listen", "closing"}
+
+// the metrics whose growth is reported, by key
+var trendKeys = map[string]bool{}
+
+func init() {
+	for _, m := range append(tcpStateMetrics(), fdsMetric, socketsMetric, pidsMetric, pidsMaxMetric) {
+		trendKeys[m.key] = true
+	}
+}
+
+func countMetric(label string, key string) metric {
+	return metric{label, key, key, false, transRate(1), "count", 1, nil, nil}
+}
+
+func tcpStateMetrics() []metric {
+	var metrics []metric
+	for _, state := range tcpStates {
+		metrics = append(metrics, countMetric("TCP "+strings.ReplaceAll(state, "_", " "), "tcp_"+state))
+	}
+	return metrics
+}
+
+// newInventoryCollector counts the files, sockets and tasks of the process every interval, until stop is closed
+func newInventoryCollector(pid string, procfs bool, interval time.Duration, stop <-chan struct{}) (collector, error) {
+
+	metrics := append([]metric{fdsMetric, socketsMetric}, tcpStateMetrics()...)
+
+	var pidsDir string
+	if !procfs {
+		var err error
+		if pidsDir, err = getPidsDirOf(pid); err != nil {
+			return collector{}, err
+		}
+	}
+	limited := false
+	if pidsDir == "" {
+		log.Print("The target has no cgroup, its tasks are not counted")
+	} else if _, err := os.Stat(pidsDir + "/pids.current"); err != nil {
+		log.Print("No pids controller for the target, its tasks are not counted")
+		pidsDir = ""
+	} else {
+		metrics = append(metrics, pidsMetric)
+		limit, err := os.ReadFile(pidsDir + "/pids.max")
+		if err == nil && strings.TrimSpace(string(limit)) != "max" {
+			metrics = append(metrics, pidsMaxMetric)
+			limited = true
+		} else {
+			log.Print("The tasks of the target are not limited by pids.max")
+		}
+	}
+
+	count := func() ([]float64, error) {
+		fds, sockets, err := countFiles(pid)
+		if err != nil {
+			return nil, err
+		}
+		values := append([]float64{fds, sockets}, countTcpStates(pid)...)
+		if pidsDir != "" {
+			current, err := os.ReadFile(pidsDir + "/pids.current")
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, stringToFloat(strings.TrimSpace(string(current))))
+		}
+		if limited {
+			// the limit may be lifted while sampling
+			limit, _ := os.ReadFile(pidsDir + "/pids.max")
+			values = append(values, stringToFloat(strings.TrimSpace(string(limit))))
+		}
+		return values, nil
+	}
+
+	first, err := count()
+	if err != nil {
+		return collector{}, fileError(errTarget, err)
+	}
+	inv := &inventory{last: first}
+	go inv.run(count, interval, stop)
+	return collector{
+		metrics: metrics,
+		read:    inv.read,
+	}, nil
+}
+
+// inventory publishes the last numbers counted to the tick of sampling
+type inventory struct {
+	mu   sync.Mutex
+	last []float64
+	// the failure of counting, e.g. the target is gone, which ends the counting
+	err error
+}
+
+func (inv *inventory) run(count func() ([]float64, error), interval time.Duration, stop <-chan struct{}) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		values, err := count()
+		inv.mu.Lock()
+		if err != nil {
+			inv.err = err
+		} else {
+			inv.last = values
+		}
+		inv.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (inv *inventory) read() ([]float64, error) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	return inv.last, inv.err
+}
+
+// trendOnly tells the metric is reported by its growth, not by average and percentiles
+func trendOnly(m metric) bool {
+	return trendKeys[m.key]
+}
+
+// countFiles returns the open file descriptors of the process, and those of them sockets
+func countFiles(pid string) (float64, float64, error) {
+
+	dir := procPath(pid, "fd")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	sockets := 0
+	for _, e := range entries {
+		// the file may be closed meanwhile
+		if link, err := os.Readlink(dir + "/" + e.Name()); err == nil && strings.HasPrefix(link, "socket:") {
+			sockets++
+		}
+	}
+	return float64(len(entries)), float64(sockets), nil
+}
+
+// countTcpStates returns the TCP sockets of IPv4 and IPv6 by state, in the order of tcpStates
+func countTcpStates(pid string) []float64 {
+
+	counts := make([]float64, len(tcpStates))
+	for _, file := range []string{"net/tcp", "net/tcp6"} {
+		// no IPv6 in the kernel
+		content, err := os.ReadFile(procPath(pid, file))
+		if err != nil {
+			continue
+		}
+		lines := strings.Split(string(content), "\n")
+		// sl local_address rem_address st ...
+		for _, line := range lines[1:] {
+			fields := strings.Fields(line)
+			if len(fields) < 4 {
+				continue
+			}
+			var state int
+			if _, err := fmt.Sscanf(fields[3], "%X", &state); err == nil && state >= 1 && state <= len(tcpStates) {
+				counts[state-1]++
+			}
+		}
+	}
+	return counts
+}
+
+// trends fits a line to every series whose growth is reported, by least squares over the time of samples.
+// It returns nil without such metrics.
+func trends(c *capture, ms int) []Trend {
+
+	var result []Trend
+	for i, m := range c.metrics {
+		if !trendKeys[m.key] || m.container != nil || m.target != nil || len(c.series[i]) < 2 {
+			continue
+		}
+		series := c.series[i]
+		// the nominal time of samples when their times are not kept, e.g. in daemon mode
+		x := make([]float64, len(series))
+		for j := range x {
+			if len(c.times) == len(series) {
+				x[j] = float64(c.times[j]-c.times[0]) / 1e6
+			} else {
+				x[j] = float64(j * ms)
+			}
+		}
+		// numbers per millisecond to per minute
+		perMinute := slope(x, series) * 60000 * m.scale
+		result = append(result, Trend{
+			Metric:    m.key,
+			Unit:      m.unitName,
+			First:     series[0] * m.scale,
+			Last:      series[len(series)-1] * m.scale,
+			PerMinute: perMinute,
+		})
+	}
+	return result
+}
+
+// slope is the slope of the least squares line of y over x, 0 if x does not vary
+func slope(x []float64, y []float64) float64 {
+
+	n := float64(len(x))
+	var sumX, sumY float64
+	for i := range x {
+		sumX += x[i]
+		sumY += y[i]
+	}
+	meanX, meanY := sumX/n, sumY/n
+	var cov, variance float64
+	for i := range x {
+		cov += (x[i] - meanX) * (y[i] - meanY)
+		variance += (x[i] - meanX) * (x[i] - meanX)
+	}
+	if variance == 0 {
+		return 0
+	}
+	return cov / variance
+}
+
+// printTrends logs the numbers which changed over the run, and their growth
+func printTrends(name string, trends []Trend) {
+	for _, t := range trends {
+		if t.First == t.Last && t.PerMinute == 0 {
+			continue
+		}
+		log.Printf("%s -- %s: %.0f to %.0f, %+.1f per minute", name, t.Metric, t.First, t.Last, t.PerMinute)
+	}
+}
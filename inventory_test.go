@@ -0,0 +1,137 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInventoryCountsInBackground(t *testing.T) {
+
+	var mu sync.Mutex
+	counted := 0
+	gone := errors.New("gone")
+	count := func() ([]float64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		counted++
+		if counted > 3 {
+			return nil, gone
+		}
+		return []float64{float64(counted)}, nil
+	}
+
+	inv := &inventory{last: []float64{0}}
+	// reading never waits on counting
+	if values, err := inv.read(); err != nil || values[0] != 0 {
+		t.Fatalf("read() = %v, %v, want the first numbers", values, err)
+	}
+	done := make(chan struct{})
+	go func() {
+		inv.run(count, time.Millisecond, nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("counting does not stop on failure")
+	}
+	if values, err := inv.read(); !errors.Is(err, gone) || values[0] != 3 {
+		t.Errorf("read() = %v, %v, want the last numbers and the failure", values, err)
+	}
+}
+
+func TestInventoryStops(t *testing.T) {
+
+	var mu sync.Mutex
+	counted := 0
+	count := func() ([]float64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		counted++
+		return []float64{float64(counted)}, nil
+	}
+
+	inv := &inventory{last: []float64{0}}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		inv.run(count, time.Millisecond, stop)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("counting does not stop once the run ends")
+	}
+
+	// no counting after the stop
+	mu.Lock()
+	stopped := counted
+	mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if counted != stopped {
+		t.Errorf("counted %d times after the stop", counted-stopped)
+	}
+	if _, err := inv.read(); err != nil {
+		t.Errorf("read() error = %v after the stop, want none", err)
+	}
+}
+
+func TestTrends(t *testing.T) {
+
+	start := time.Unix(1650000000, 0).UnixNano()
+	minute := time.Minute.Nanoseconds()
+	c := &capture{
+		metrics: []metric{fdsMetric, memMetric, socketsMetric},
+		series: [][]float64{
+			{10, 20, 30, 40},
+			{1, 2, 3, 4},
+			{5, 5, 5, 5},
+		},
+		// irregular ticks, the slope follows the time of samples
+		times: []int64{start, start + minute, start + 2*minute, start + 3*minute},
+	}
+	want := []Trend{
+		{Metric: "fds", Unit: "count", First: 10, Last: 40, PerMinute: 10},
+		{Metric: "sockets", Unit: "count", First: 5, Last: 5, PerMinute: 0},
+	}
+	got := trends(c, 1000)
+	for i := range got {
+		// least squares in floating point
+		got[i].PerMinute = math.Round(got[i].PerMinute*1e9) / 1e9
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("trends() = %+v, want %+v", got, want)
+	}
+
+	// without the times of samples, e.g. in daemon mode, the samples are a span apart
+	c.times = nil
+	if got := trends(c, 30000); math.Abs(got[0].PerMinute-20) > 1e-9 {
+		t.Errorf("trends() by span = %+v, want fds growing by 20 per minute", got[0])
+	}
+
+	if !trendOnly(fdsMetric) || trendOnly(memMetric) {
+		t.Error("trendOnly() does not tell the numbers of inventory apart")
+	}
+}
@@ -16,23 +16,19 @@
 
 APP_YAML=
 HOSTNAME=
-USER=
 CMD_KEYWORD=
 
-kubectl create -f $APP_YAML
-
-# mimic a random time to trigger colibri
-sleep 10
-
-pid=$(ssh $USER@$HOSTNAME ps aux | grep $CMD_KEYWORD | grep "root" | awk '{print $2}')
-
 cp colibri.yml $CMD_KEYWORD.yml
 
-sed -i "s/APP_PID/$pid/g" $CMD_KEYWORD.yml
+sed -i "s/nodeName: HOSTNAME/nodeName: $HOSTNAME/" $CMD_KEYWORD.yml
+# colibri waits for the process of the application, whose command line matches the keyword
+sed -i "s|\"--pid\", \"\$(PID)\"|\"--wait-for\", \"cmd:$CMD_KEYWORD\"|" $CMD_KEYWORD.yml
 
 kubectl create -f $CMD_KEYWORD.yml
 
-# wait a while for metrics colleciton, change to any closer time to your querying configurations
+kubectl create -f $APP_YAML
+
+# wait a while for metrics colleciton, change to any closer time to DURATION in colibri.yml
 sleep 20
 
 colibri_pod=$(kubectl get pod | grep "colibri-job" | awk '{print $1}')
@@ -0,0 +1,164 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// PodInfo is what Colibri API server needs to know about a Pod for validating results
+type PodInfo struct {
+	Namespace  string   `json:"namespace"`
+	Name       string   `json:"name"`
+	Node       string   `json:"node"`
+	Containers []string `json:"containers"`
+}
+
+// podLookup finds Pods for validating the identifiers of results.
+// lookupPod returns nil without error if the Pod does not exist.
+type podLookup interface {
+	lookupPod(namespace string, name string) (*PodInfo, error)
+}
+
+// staticLookup serves a fixed list of Pods, for tests and running the server without Kubernetes
+type staticLookup map[string]*PodInfo
+
+func newStaticLookup(pods ...*PodInfo) staticLookup {
+	l := make(staticLookup)
+	for _, p := range pods {
+		l[p.Namespace+"/"+p.Name] = p
+	}
+	return l
+}
+
+// loadStaticLookup reads a JSON array of PodInfo
+func loadStaticLookup(path string) (staticLookup, error) {
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fileError(errUsage, err)
+	}
+
+	var pods []*PodInfo
+	if err = json.Unmarshal(content, &pods); err != nil {
+		return nil, newError(errUsage, "malformed Pod list %s: %v", path, err)
+	}
+	return newStaticLookup(pods...), nil
+}
+
+func (l staticLookup) lookupPod(namespace string, name string) (*PodInfo, error) {
+	return l[namespace+"/"+name], nil
+}
+
+// kubeLookup asks the Kubernetes API server with the service account of Colibri API server
+type kubeLookup struct {
+	client *apiClient
+}
+
+func newKubeLookup() (*kubeLookup, error) {
+	client, err := newApiClient(apiConfig{
+		url:       "https://kubernetes.default.svc/",
+		caFile:    CaFile,
+		tokenFile: TokenFile,
+		timeout:   10 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &kubeLookup{client}, nil
+}
+
+// kubePod is the part of a Pod object read by Colibri API server and wait mode
+type kubePod struct {
+	Metadata struct {
+		Uid string `json:"uid"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName   string `json:"nodeName"`
+		Containers []struct {
+			Name string `json:"name"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		ContainerStatuses []struct {
+			Name string `json:"name"`
+			// <runtime>://<ID>, empty until the container is created
+			ContainerId string `json:"containerID"`
+		} `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+// getPod reads a Pod from Kubernetes API server, nil without error if the Pod does not exist
+func (l *kubeLookup) getPod(namespace string, name string) (*kubePod, error) {
+
+	var pod kubePod
+	status, err := l.client.get("api/v1/namespaces/"+url.PathEscape(namespace)+"/pods/"+url.PathEscape(name), &pod)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+	if status/100 != 2 {
+		return nil, newError(errApi, "Kubernetes API responds %d for Pod %s/%s", status, namespace, name)
+	}
+	return &pod, nil
+}
+
+func (l *kubeLookup) lookupPod(namespace string, name string) (*PodInfo, error) {
+
+	pod, err := l.getPod(namespace, name)
+	if pod == nil {
+		return nil, err
+	}
+
+	info := &PodInfo{Namespace: namespace, Name: name, Node: pod.Spec.NodeName}
+	for _, c := range pod.Spec.Containers {
+		info.Containers = append(info.Containers, c.Name)
+	}
+	return info, nil
+}
+
+// podStatus is the UID of a Pod, and the runtime IDs of its started containers
+type podStatus struct {
+	uid string
+	// the names of containers in the order of the spec
+	names []string
+	ids   map[string]string
+}
+
+// lookupStatus returns the status of a Pod, nil without error if the Pod does not exist
+func (l *kubeLookup) lookupStatus(namespace string, name string) (*podStatus, error) {
+
+	pod, err := l.getPod(namespace, name)
+	if pod == nil {
+		return nil, err
+	}
+
+	s := &podStatus{uid: pod.Metadata.Uid, ids: make(map[string]string)}
+	for _, c := range pod.Spec.Containers {
+		s.names = append(s.names, c.Name)
+	}
+	for _, c := range pod.Status.ContainerStatuses {
+		if id := containerIdRegexp.FindString(c.ContainerId); id != "" {
+			s.ids[c.Name] = id
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,718 @@
+// Copyright 2022 Carol Hsu
+// 
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// 
+//     http://www.apache.org/licenses/LICENSE-2.0
+// 
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+    "flag"
+    "log"
+    "math"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+)
+
+type Scraper struct {
+    // The process ID of the container
+    pid string
+    // The postfix name of output file
+    out string
+    // The metric scraping timespan in millisecond
+    ms int
+    // The scrapping #iteration
+    iter int
+    // The percentile for output
+    pert float64
+    // The process has no dedicated cgroup, read its numbers from procfs
+    procfs bool
+    // Closed when the target terminates, nil if it is not watched
+    done <-chan struct{}
+    // The time length of collection, 0 for no limit
+    duration time.Duration
+    // Stop normally when the target exits
+    untilExit bool
+    // Closed when Colibri is asked to stop by signal
+    interrupt <-chan struct{}
+    // Receivers of live samples
+    sinks []sink
+    // Keep no raw numbers in daemon mode, the sinks summarize them
+    daemon bool
+    // Reads the target across restarts in follow mode, nil otherwise
+    follow *follower
+    // Breaks the CPU down by process and thread with --top, nil otherwise
+    tasks *taskTracker
+    // The memory limit of the target in bytes, 0 if unlimited or unknown
+    memLimit float64
+}
+
+const output_path = "/output/"
+
+// options are the command line flags of Colibri
+type options struct {
+    name, metricType, out, iface, procRoot, cgroupRoot string
+    // the targets, given more than once to sample them on the same tick
+    pids, waitFor stringList
+    span, iter, maxSamples int
+    pert float64
+    host, untilExit, json bool
+    duration time.Duration
+    api apiConfig
+    // the Prometheus endpoint
+    listen string
+    window time.Duration
+    otlp otlpConfig
+    // Pod mode
+    pod bool
+    // follow mode
+    follow string
+    followTimeout time.Duration
+    // wait mode
+    waitTimeout time.Duration
+    // context mode
+    context bool
+    // the busiest processes and threads to report, and the limit of threads tracked
+    top, maxTasks int
+    // the scheduler and protocol collectors
+    sched, proto bool
+    // the interval of counting files, sockets and tasks, 0 to disable
+    inventory time.Duration
+    // daemon mode
+    daemon bool
+    daemonConfig daemonConfig
+    // the writers of raw samples
+    influx, influxToken, remoteWrite string
+    batch batchConfig
+
+    // exec mode: colibri run [flags] -- <cmd> args...
+    execMode bool
+    // agent mode: colibri agent [flags]
+    agentMode bool
+    rescan time.Duration
+    // --iter is given explicitly
+    iterSet bool
+}
+
+func parseFlags() *options {
+
+    o := &options{}
+
+    o.execMode = len(os.Args) > 1 && os.Args[1] == "run"
+    o.agentMode = len(os.Args) > 1 && os.Args[1] == "agent"
+    if o.execMode || o.agentMode {
+        os.Args = append(os.Args[:1], os.Args[2:]...)
+    }
+
+    flag.StringVar(&o.name, "name", "birdy", "The name of this work to indicate for standard output. (default: birdy)")
+    flag.StringVar(&o.metricType, "mtype", "cpu", "What metric to s.t: cpu/mem/net/io/all. (default: cpu)")
+    flag.Var(&o.pids, "pid", "The process ID of the container, or \"self\" for Colibri itself in host mode. Repeat it to profile several targets")
+    flag.IntVar(&o.span, "span", 5, "The scraping interval/timespan in millisecond. (default: 5)")
+    flag.IntVar(&o.iter, "iter", 2000, "The scraping numbers. Only applied when no other stop condition is given, or set explicitly. (default: 2000)")
+    flag.DurationVar(&o.duration, "duration", 0, "Stop after the time length, e.g. 30s or 5m")
+    flag.BoolVar(&o.untilExit, "until-exit", false, "Stop when the target process exits, as a normal end of collection")
+    flag.IntVar(&o.maxSamples, "max-samples", 0, "Stop after the number of samples")
+    flag.Float64Var(&o.pert, "pert", 95, "The percentile value for analytics. (default: 95)")
+    flag.StringVar(&o.out, "out", "none", "Output file or API unique ID for storing the metrics")
+    flag.StringVar(&o.iface, "iface", "", "The network interface of the container, or a glob like 'eth*' for several. Only used for s.abbing network metrics. Empty for the interface of the default route")
+    flag.StringVar(&o.listen, "listen", "", "Expose live metrics in Prometheus format at the address, e.g. :9090. Empty to disable")
+    flag.DurationVar(&o.window, "window", time.Second, "The rolling window of max and percentile gauges for Prometheus")
+    flag.StringVar(&o.otlp.endpoint, "otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "The base URL of an OpenTelemetry collector to export metrics with OTLP/HTTP, e.g. http://localhost:4318. Empty to disable")
+    flag.DurationVar(&o.otlp.interval, "otlp-interval", 10*time.Second, "The interval of sending batched samples with OTLP")
+    flag.DurationVar(&o.otlp.timeout, "otlp-timeout", 10*time.Second, "The timeout of each request to the OpenTelemetry collector")
+    flag.StringVar(&o.influx, "influx", "", "Write every sample in InfluxDB line protocol to the write URL, or to file:<path>. Empty to disable")
+    flag.StringVar(&o.influxToken, "influx-token", "", "The file of the InfluxDB API token, empty for no authorization")
+    flag.StringVar(&o.remoteWrite, "remote-write", "", "Write every sample to the Prometheus remote-write URL. Empty to disable")
+    flag.IntVar(&o.batch.size, "batch-size", 1000, "The samples in a batch written to InfluxDB or Prometheus remote-write")
+    flag.DurationVar(&o.batch.interval, "batch-interval", 5*time.Second, "The longest time a sample waits for its batch to be written")
+    flag.BoolVar(&o.pod, "pod", false, "Profile the Pod of the process given by --pid: the Pod aggregate and every container in it")
+    flag.StringVar(&o.follow, "follow", "", "Follow the target across restarts, identified by container:<ID> or cgroup:<path> instead of --pid. Empty to disable")
+    flag.DurationVar(&o.followTimeout, "follow-timeout", 5*time.Minute, "The longest time to wait for the target to restart in follow mode")
+    flag.Var(&o.waitFor, "wait-for", "Wait for a process matching pod:<namespace>/<pod>[/<container>], cmd:<regexp> or cgroup:<pattern> instead of --pid. Repeat it to profile several targets")
+    flag.DurationVar(&o.waitTimeout, "wait-timeout", 5*time.Minute, "The longest time to wait for a process matching --wait-for")
+    flag.BoolVar(&o.context, "context", false, "Also sample the node and the neighbor containers, and correlate the stalls of the target with their activity")
+    flag.IntVar(&o.top, "top", 0, "Also report the busiest processes and threads under the target, up to the number. 0 to disable")
+    flag.IntVar(&o.maxTasks, "max-tasks", 256, "The most threads tracked for --top and --sched, the others are left out")
+    flag.BoolVar(&o.sched, "sched", false, "Also sample the run queue delay and the context switches of the threads of the target")
+    flag.DurationVar(&o.inventory, "inventory", 0, "Also count the open files, sockets and tasks of the target at the interval, e.g. 1s. 0 to disable")
+    flag.BoolVar(&o.proto, "proto", false, "Also sample the TCP and UDP counters of the network namespace of the target")
+    flag.BoolVar(&o.daemon, "daemon", false, "Sample continuously, and emit a summary of every --summary-interval until stopped by signal")
+    flag.DurationVar(&o.daemonConfig.interval, "summary-interval", 10*time.Second, "The window of every summary in daemon mode")
+    flag.Int64Var(&o.daemonConfig.rotateSize, "rotate-size", 10<<20, "The size in bytes of the summaries file to rotate it in daemon mode")
+    flag.IntVar(&o.daemonConfig.rotateKeep, "rotate-keep", 5, "The rotated summaries files to keep in daemon mode")
+    flag.DurationVar(&o.rescan, "rescan", 5*time.Second, "The interval of looking for new containers in agent and context mode")
+    flag.BoolVar(&o.json, "json", false, "Print the result document in JSON to standard output")
+    flag.BoolVar(&o.host, "host", false, "Profile any process of the host rather than a container under kubepods")
+    flag.StringVar(&o.procRoot, "proc-root", "/proc", "The mounting point of host's /proc. Only used in host mode. (default: /proc)")
+    flag.StringVar(&o.cgroupRoot, "cgroup-root", "/sys/fs/cgroup", "The mounting point of host's cgroup filesystem. Only used in host mode. (default: /sys/fs/cgroup)")
+    flag.StringVar(&o.api.url, "api-url", Url, "The base URL of Colibri API, the ID after \"api:\" is appended")
+    flag.StringVar(&o.api.caFile, "api-ca", CaFile, "The CA certificate of Colibri API, empty for the system pool")
+    flag.StringVar(&o.api.tokenFile, "api-token", TokenFile, "The bearer token file for Colibri API, empty for no authorization")
+    flag.DurationVar(&o.api.timeout, "api-timeout", 10*time.Second, "The timeout of each request to Colibri API")
+    flag.IntVar(&o.api.retries, "api-retries", 3, "The retries with exponential backoff when calling Colibri API fails")
+    flag.StringVar(&o.api.spool, "api-spool", "", "The directory keeping results failed to send, resent by later runs. Empty to disable")
+    if o.execMode {
+        // the flag package exits with 2 on invalid flags, a code the command may exit with
+        flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+        if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+            if err == flag.ErrHelp {
+                os.Exit(0)
+            }
+            os.Exit(exitExecFailure)
+        }
+    } else {
+        flag.Parse()
+    }
+
+    if len(o.pids) == 0 {
+        o.pids = stringList{"0"}
+    }
+
+    flag.Visit(func(f *flag.Flag) {
+        if f.Name == "iter" {
+            o.iterSet = true
+        }
+    })
+
+    return o
+}
+
+// validate checks all flags before sampling starts
+func (o *options) validate() error {
+
+    if o.span <= 0 {
+        return newError(errUsage, "--span must be larger than 0 millisecond, got %d", o.span)
+    }
+    if o.pert <= 0 || o.pert > 100 {
+        return newError(errUsage, "--pert must be in (0, 100], got %v", o.pert)
+    }
+    if o.iter <= 0 {
+        return newError(errUsage, "--iter must be larger than 0, got %d", o.iter)
+    }
+    if o.maxSamples < 0 {
+        return newError(errUsage, "--max-samples cannot be negative, got %d", o.maxSamples)
+    }
+    if o.duration < 0 {
+        return newError(errUsage, "--duration cannot be negative, got %s", o.duration)
+    }
+
+    switch o.metricType {
+    case "cpu", "mem", "io":
+    case "net", "all":
+        if _, err := filepath.Match(o.iface, ""); err != nil {
+            return newError(errUsage, "malformed --iface pattern %q: %v", o.iface, err)
+        }
+    default:
+        return newError(errUsage, "metric type %q is not in the handling list: cpu/mem/net/io/all", o.metricType)
+    }
+
+    switch {
+    case o.out == "none":
+    case strings.HasPrefix(o.out, "file:") && len(o.out) > len("file:"):
+    case strings.HasPrefix(o.out, "api:") && len(o.out) > len("api:"):
+    default:
+        return newError(errUsage, "--out must be none, file:<prefix> or api:<namespace>.<pod>.<pid>, got %q", o.out)
+    }
+
+    if o.listen != "" && o.window < time.Duration(o.span) * time.Millisecond {
+        return newError(errUsage, "--window must cover a span at least, got %s", o.window)
+    }
+
+    if o.otlp.endpoint != "" {
+        if err := o.otlp.validate(); err != nil {
+            return err
+        }
+    }
+
+    if o.daemon || o.agentMode {
+        if err := o.daemonConfig.validate(o.span); err != nil {
+            return err
+        }
+    }
+
+    if o.agentMode {
+        switch {
+        case o.metricType != "cpu" && o.metricType != "mem" && o.metricType != "all":
+            return newError(errUsage, "agent mode samples cpu, mem or all of them, got %q", o.metricType)
+        case strings.HasPrefix(o.out, "api:"):
+            return newError(errUsage, "agent mode cannot send to Colibri API, the result ID names a single process")
+        case o.otlp.endpoint != "" || o.influx != "" || o.remoteWrite != "":
+            return newError(errUsage, "agent mode exposes live numbers with --listen only")
+        case o.rescan <= 0:
+            return newError(errUsage, "--rescan must be positive, got %s", o.rescan)
+        }
+        return nil
+    }
+
+    if o.pod {
+        switch {
+        case o.execMode:
+            return newError(errUsage, "Pod mode profiles a running Pod, it cannot run a command")
+        case o.metricType == "io":
+            return newError(errUsage, "Pod mode samples cpu, mem, net or all of them, got %q", o.metricType)
+        }
+    }
+
+    if o.follow != "" {
+        if _, err := parseFollowSelector(o.follow); err != nil {
+            return err
+        }
+        switch {
+        case o.execMode || o.pod:
+            return newError(errUsage, "follow mode cannot be combined with exec or Pod mode")
+        case o.untilExit:
+            return newError(errUsage, "follow mode waits for the target to restart, it cannot stop --until-exit")
+        case o.followTimeout <= 0:
+            return newError(errUsage, "--follow-timeout must be positive, got %s", o.followTimeout)
+        }
+    }
+
+    if len(o.waitFor) > 0 {
+        for _, s := range o.waitFor {
+            if _, err := parseTargetSelector(s); err != nil {
+                return err
+            }
+        }
+        switch {
+        case o.execMode || o.follow != "":
+            return newError(errUsage, "wait mode cannot be combined with exec or follow mode")
+        case o.waitTimeout <= 0:
+            return newError(errUsage, "--wait-timeout must be positive, got %s", o.waitTimeout)
+        }
+    }
+
+    if o.influx != "" || o.remoteWrite != "" {
+        if err := o.batch.validate(); err != nil {
+            return err
+        }
+    }
+    if o.influx != "" && !strings.HasPrefix(o.influx, "file:") && !strings.HasPrefix(o.influx, "http://") && !strings.HasPrefix(o.influx, "https://") {
+        return newError(errUsage, "--influx must be an http or https URL, or file:<path>, got %q", o.influx)
+    }
+    if o.remoteWrite != "" && !strings.HasPrefix(o.remoteWrite, "http://") && !strings.HasPrefix(o.remoteWrite, "https://") {
+        return newError(errUsage, "--remote-write must be an http or https URL, got %q", o.remoteWrite)
+    }
+
+    if strings.HasPrefix(o.out, "api:") {
+        if err := o.api.validate(); err != nil {
+            return err
+        }
+    }
+
+    if o.top < 0 || o.maxTasks <= 0 {
+        return newError(errUsage, "--top must not be negative and --max-tasks must be positive")
+    }
+    if o.top > 0 && (o.follow != "" || o.targets() > 1) {
+        return newError(errUsage, "--top breaks down a single process tree, it cannot be combined with follow mode or several targets")
+    }
+    if o.inventory < 0 {
+        return newError(errUsage, "--inventory cannot be negative, got %s", o.inventory)
+    }
+    if o.inventory > 0 && (o.follow != "" || o.targets() > 1) {
+        return newError(errUsage, "--inventory counts the files of a single process, it cannot be combined with follow mode or several targets")
+    }
+    if o.proto && (o.follow != "" || o.targets() > 1) {
+        return newError(errUsage, "--proto samples the network namespace of a single process, it cannot be combined with follow mode or several targets")
+    }
+    if o.sched && (o.follow != "" || o.targets() > 1) {
+        return newError(errUsage, "--sched samples the threads of a single process, it cannot be combined with follow mode or several targets")
+    }
+
+    if o.execMode {
+        if flag.NArg() == 0 {
+            return newError(errUsage, "no command is given, usage: colibri run [flags] -- <cmd> args...")
+        }
+        return nil
+    }
+
+    if o.context && (o.pod || o.follow != "" || o.targets() > 1) {
+        return newError(errUsage, "context mode profiles a single target, it cannot be combined with Pod or follow mode")
+    }
+
+    if o.targets() > 1 {
+        switch {
+        case o.pod || o.follow != "":
+            return newError(errUsage, "several targets cannot be combined with Pod or follow mode")
+        case strings.HasPrefix(o.out, "api:"):
+            return newError(errUsage, "several targets cannot be sent to Colibri API, the result ID names a single process")
+        }
+    }
+
+    if o.follow != "" || len(o.waitFor) > 0 {
+        return nil
+    }
+    seen := make(map[string]bool)
+    for _, pid := range o.pids {
+        if seen[pid] {
+            return newError(errUsage, "--pid %s is given more than once", pid)
+        }
+        seen[pid] = true
+        if o.host && pid == "self" {
+            continue
+        }
+        if n, err := strconv.Atoi(pid); err != nil || n <= 0 {
+            return newError(errUsage, "--pid must be a positive process ID, got %q", pid)
+        }
+    }
+    return nil
+}
+
+// targets returns the number of targets to profile
+func (o *options) targets() int {
+    if len(o.waitFor) > 0 {
+        return len(o.waitFor)
+    }
+    return len(o.pids)
+}
+
+// stringList is a flag given more than once
+type stringList []string
+
+func (l *stringList) String() string {
+    return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+    *l = append(*l, value)
+    return nil
+}
+
+// sampleLimit returns the maximum number of samples.
+// --iter limits the sampling if it is set, or nothing else is given to stop.
+func (o *options) sampleLimit() int {
+
+    limit := math.MaxInt
+    if o.maxSamples > 0 {
+        limit = o.maxSamples
+    }
+    if o.iterSet || (o.maxSamples == 0 && o.duration == 0 && !o.untilExit && !o.execMode && !o.daemon) {
+        if o.iter < limit {
+            limit = o.iter
+        }
+    }
+    return limit
+}
+
+func main () {
+
+    log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+
+    var err error
+    if len(os.Args) > 1 && os.Args[1] == "server" {
+        err = runServer(os.Args[2:])
+    } else if o := parseFlags(); o.agentMode {
+        if err = o.validate(); err == nil {
+            err = runAgent(o)
+        }
+    } else if err = run(o); err != nil && o.execMode {
+        os.Exit(execExitCode(err))
+    }
+    if err != nil {
+        os.Exit(exitCode(err))
+    }
+}
+
+func run(o *options) (err error) {
+
+    if err = o.validate(); err != nil {
+        return err
+    }
+
+    pids := append([]string(nil), o.pids...)
+    var cmd *child
+    var done chan struct{}
+
+    if o.execMode {
+        // the command is a plain process on the host, profiled until it exits
+        o.host = true
+        cmd, err = startCommand(flag.Args())
+        if err != nil {
+            return err
+        }
+        // do not leave the command behind if Colibri fails
+        defer func() {
+            if err != nil {
+                cmd.cmd.Process.Kill()
+            }
+        }()
+        pids = []string{cmd.pid()}
+        done = cmd.done
+    }
+
+    if o.host {
+        setHostMode(o.procRoot, o.cgroupRoot)
+        for i := range pids {
+            pids[i] = resolvePid(pids[i])
+        }
+    }
+
+    // in exec mode, the signals are forwarded to the command instead
+    var interrupt <-chan struct{}
+    if !o.execMode {
+        interrupt = watchInterrupt()
+    }
+
+    if len(o.waitFor) > 0 {
+        // the selectors share the timeout
+        pids = nil
+        waitStart := time.Now()
+        for _, s := range o.waitFor {
+            selector, _ := parseTargetSelector(s)
+            log.Printf("Waiting up to %s for a process matching %s", o.waitTimeout - time.Since(waitStart), selector)
+            found, err := waitForTarget(selector, o.waitTimeout - time.Since(waitStart), time.Duration(o.span) * time.Millisecond, interrupt)
+            if err != nil {
+                return err
+            }
+            log.Printf("Found process %s matching %s after %s", found, selector, time.Since(waitStart).Round(time.Millisecond))
+            pids = append(pids, found)
+        }
+        // selectors matching the same process would profile it twice
+        seen := make(map[string]string)
+        for i, pid := range pids {
+            if s, ok := seen[pid]; ok {
+                return newError(errUsage, "--wait-for %s and %s match the same process %s", s, o.waitFor[i], pid)
+            }
+            seen[pid] = o.waitFor[i]
+        }
+    }
+    pid := pids[0]
+
+    var follow *follower
+    if o.follow != "" {
+        selector, _ := parseFollowSelector(o.follow)
+        follow = newFollower(selector, o.followTimeout, o.metricType, o.iface)
+        if pid, err = follow.attach(); err != nil {
+            return err
+        }
+        log.Printf("Follow mode: profiling %s, process %s", selector, pid)
+    }
+
+    if o.host {
+        log.Printf("Host mode: profiling process %s with cgroup v%d", strings.Join(pids, ", "), cgroupVersion)
+    }
+
+    // set up the API client before sampling, so a wrong configuration fails early
+    var api *apiClient
+    if strings.HasPrefix(o.out, "api:") {
+        if api, err = newApiClient(o.api); err != nil {
+            return err
+        }
+        api.resendSpool()
+    }
+
+    // a followed cgroup is read as a whole, and every one of several targets decides for itself
+    procfs := false
+    if follow == nil && len(pids) == 1 {
+        if procfs, err = useProcfs(pid); err != nil {
+            return err
+        }
+    }
+
+    scraper := Scraper{
+        pid: pid,
+        out: o.out,
+        ms: o.span,
+        iter: o.sampleLimit(),
+        pert: o.pert,
+        procfs: procfs,
+        done: done,
+        duration: o.duration,
+        untilExit: o.untilExit,
+        interrupt: interrupt,
+        daemon: o.daemon,
+        follow: follow,
+    }
+
+    var pod *podInfo
+    var collectors []collector
+    log.Print("Starting to get metrics: ", o.metricType)
+    if o.pod {
+        if pod, err = resolvePod(pid); err != nil {
+            return err
+        }
+        log.Printf("Pod mode: profiling Pod %s (%s) with %d containers", pod.uid, pod.qosClass, len(pod.containers))
+        collectors, err = scraper.newPodCollectors(pod, o.metricType, o.iface)
+    } else if follow != nil {
+        collectors = follow.collectors
+    } else if len(pids) > 1 {
+        log.Printf("Profiling %d targets on the same tick", len(pids))
+        collectors, err = scraper.newTargetCollectors(pids, o.metricType, o.iface)
+    } else {
+        collectors, err = scraper.newCollectors(o.metricType, o.iface)
+    }
+    if err != nil {
+        return err
+    }
+    if o.context {
+        contextCollectors, err := newContextCollectors(pid, procfs, o.rescan)
+        if err != nil {
+            return err
+        }
+        collectors = append(collectors, contextCollectors...)
+    }
+    if o.sched {
+        sched, err := newSchedCollector(pid, o.maxTasks)
+        if err != nil {
+            return err
+        }
+        collectors = append(collectors, sched)
+    }
+    if o.inventory > 0 {
+        // counting runs in the background, until the run ends
+        stop := make(chan struct{})
+        defer close(stop)
+        inventory, err := newInventoryCollector(pid, procfs, o.inventory, stop)
+        if err != nil {
+            return err
+        }
+        collectors = append(collectors, inventory)
+    }
+    if o.proto {
+        proto, err := newProtoCollector(pid)
+        if err != nil {
+            return err
+        }
+        collectors = append(collectors, proto)
+    }
+    if o.top > 0 {
+        scraper.tasks = newTaskTracker(pid, o.top, o.maxTasks)
+        collectors = append(collectors, scraper.tasks.collector())
+    }
+    metrics := metricsOf(collectors)
+
+    // the limit the working set is projected to
+    switch {
+    case pod != nil:
+        scraper.memLimit = readMemoryLimit(memoryLimitPathAt(pod.path))
+    case follow != nil:
+        scraper.memLimit = readMemoryLimit(memoryLimitPathAt(follow.cgroup()))
+    case len(pids) == 1 && !procfs:
+        path, _ := memoryLimitPathOf(pid)
+        scraper.memLimit = readMemoryLimit(path)
+    }
+
+    var command []string
+    if o.execMode {
+        command = flag.Args()
+    }
+    target := newTarget(scraper, command)
+    if len(pids) > 1 {
+        // the first of several targets identifies the run
+        target = *metrics[0].target
+    }
+    if pod != nil {
+        target.PodUid, target.QosClass, target.Cgroup = pod.uid, pod.qosClass, pod.path
+    }
+
+    outputs, err := newLiveOutputs(o)
+    if err != nil {
+        return err
+    }
+    for _, g := range groupMetrics(metrics) {
+        t := target
+        if g.container != nil {
+            t.Pid, t.ContainerId = g.container.pid, g.container.containerId
+        }
+        if g.target != nil {
+            t = *g.target
+        }
+        sinks, err := outputs.attach(t, g.metrics, g.offset, len(metrics))
+        if err != nil {
+            return err
+        }
+        scraper.sinks = append(scraper.sinks, sinks...)
+    }
+
+    var summaries *summarizer
+    var summariesFile *rotatingFile
+    if o.daemon {
+        if strings.HasPrefix(scraper.out, "file:") {
+            summariesFile, err = openRotatingFile(scraper.outputPrefix() + "ms_summaries.jsonl", o.daemonConfig.rotateSize, o.daemonConfig.rotateKeep)
+            if err != nil {
+                return err
+            }
+            defer summariesFile.close()
+        }
+        summaries = newSummarizer(o.daemonConfig, metrics, summaryEmitter(o.name, scraper, target, api, summariesFile, o.json))
+        scraper.sinks = append(scraper.sinks, summaries)
+        log.Printf("Daemon mode: emitting a summary every %s", o.daemonConfig.interval)
+    }
+
+    c, err := scraper.collect(collectors)
+    outputs.closeWriters()
+    if summaries != nil {
+        summaries.close()
+    }
+    if err != nil {
+        return err
+    }
+
+    if o.daemon {
+        if err = outputs.closeOtlp(c); err != nil {
+            return err
+        }
+        // a signal is the normal end of a daemon
+        log.Print("Colibri daemon is stopped")
+        return nil
+    }
+    log.Print("Metrics collection is finished. Start to post-process data ...")
+
+    scraper.printResults(o.name, c)
+
+    r := newResult(o.name, scraper, target, c)
+    if scraper.tasks != nil {
+        r.Processes, r.Threads = scraper.tasks.take(c.end)
+        printTasks(o.name, r.Processes, r.Threads)
+    }
+    doc, err := r.marshal()
+    if err != nil {
+        return &Error{errInternal, err}
+    }
+
+    if o.json {
+        os.Stdout.Write(append(doc, '\n'))
+    }
+
+    //if outputName == none, then don't write out, just print analysis result
+    if strings.HasPrefix(scraper.out, "file:") {
+        if err = scraper.writeOutputs(c); err != nil {
+            return err
+        }
+        if err = writeOutputFile(scraper.outputPrefix() + "ms_result.json", []string{string(doc)}); err != nil {
+            return err
+        }
+    }
+
+    if strings.HasPrefix(scraper.out, "api:") {
+        log.Println("Calling API!")
+        if err = api.send(doc, scraper.out[4:]); err != nil {
+            return err
+        }
+    }
+
+    if err = outputs.closeOtlp(c); err != nil {
+        return err
+    }
+
+    if scraper.interrupted() {
+        return newError(errInterrupted, "stopped by signal")
+    }
+
+    log.Print("Colibri is successfully completed !")
+
+    if o.execMode {
+        return commandExit(cmd.exitCode())
+    }
+    return nil
+}
@@ -0,0 +1,176 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The memory trend tells if the working set of the target steadily grows over a capture. The line is fitted
+// by the Theil-Sen estimator, the median of the slopes between all pairs of samples, which a few spikes of
+// allocation or reclaim do not bend. A growth both consistent and large is reported as a leak, together with
+// the time left until the working set reaches the memory limit of the cgroup at that pace.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/montanaflynn/stats"
+)
+
+const (
+	// the samples fitted at most, evenly picked from longer captures, as the pairs grow by the square
+	maxTrendSamples = 500
+	// the samples, and the length of capture in seconds, needed to tell a trend
+	minTrendSamples = 10
+	minTrendSeconds = 10
+	// a leak grows in this share of the pairs of samples at least
+	leakConfidence = 0.8
+	// and by this share of the working set over the capture at least
+	leakGrowth = 0.05
+	// over a capture of this length at least, the growth of shorter ones, e.g. warming up, is only growing
+	minLeakMinutes = 1
+	// the time to the limit logged at most, the slope tells nothing that far
+	maxTimeToLimit = 365 * 24 * time.Hour
+	// cgroup v1 tells no limit by a number near the largest of int64
+	unlimitedMemory = 1 << 62
+)
+
+// readMemoryLimit returns the memory limit in the file, 0 if there is none or it is unlimited
+func readMemoryLimit(path string) float64 {
+	if path == "" {
+		return 0
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	// "max" on cgroup v2 reads 0
+	limit := stringToFloat(strings.TrimSpace(string(content)))
+	if limit >= unlimitedMemory {
+		return 0
+	}
+	return limit
+}
+
+// memoryTrend fits the working set of the target, nil without it
+func memoryTrend(c *capture, ms int, limit float64) *MemoryTrend {
+
+	var series []float64
+	for i, m := range c.metrics {
+		if m.key == memMetric.key && m.container == nil && m.target == nil {
+			series = c.series[i]
+			break
+		}
+	}
+	if series == nil {
+		return nil
+	}
+	if len(series) < minTrendSamples {
+		return &MemoryTrend{Verdict: "insufficient", LimitBytes: limit}
+	}
+
+	// the minutes and MiB of the samples fitted
+	n := len(series)
+	if n > maxTrendSamples {
+		n = maxTrendSamples
+	}
+	x, y := make([]float64, n), make([]float64, n)
+	for j := range x {
+		i := j * (len(series) - 1) / (n - 1)
+		if len(c.times) == len(series) {
+			x[j] = float64(c.times[i]-c.times[0]) / float64(time.Minute)
+		} else {
+			x[j] = float64(i*ms) / float64(time.Minute/time.Millisecond)
+		}
+		y[j] = series[i] / (1 << 20)
+	}
+
+	var slopes []float64
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			if x[j] > x[i] {
+				slopes = append(slopes, (y[j]-y[i])/(x[j]-x[i]))
+			}
+		}
+	}
+	if len(slopes) == 0 {
+		return &MemoryTrend{Verdict: "insufficient", LimitBytes: limit}
+	}
+	// the slope of a short capture is no trend, but the noise of a few allocations
+	if x[n-1]*60 < minTrendSeconds {
+		return &MemoryTrend{Verdict: "insufficient", LimitBytes: limit}
+	}
+	slope, _ := stats.Median(slopes)
+
+	// the share of pairs agreeing with the direction of the slope
+	agree := 0
+	for _, s := range slopes {
+		if (slope > 0 && s > 0) || (slope < 0 && s < 0) || (slope == 0 && s == 0) {
+			agree++
+		}
+	}
+	trend := &MemoryTrend{
+		SlopeMiBPerMinute: slope,
+		Confidence:        float64(agree) / float64(len(slopes)),
+		Verdict:           "stable",
+		LimitBytes:        limit,
+	}
+
+	// the working set at the end of the fitted line
+	residuals := make([]float64, n)
+	for j := range x {
+		residuals[j] = y[j] - slope*x[j]
+	}
+	intercept, _ := stats.Median(residuals)
+	end := intercept + slope*x[n-1]
+	median, _ := stats.Median(y)
+
+	if slope > 0 && trend.Confidence >= leakConfidence && slope*x[n-1] >= leakGrowth*median {
+		trend.Verdict = "growing"
+		if x[n-1] >= minLeakMinutes {
+			trend.Verdict = "leak"
+		}
+	}
+	if trend.Verdict != "stable" && limit > 0 {
+		left := limit/(1<<20) - end
+		if left < 0 {
+			left = 0
+		}
+		seconds := left / slope * 60
+		trend.TimeToLimitSeconds = &seconds
+	}
+	return trend
+}
+
+// printMemoryTrend logs the trend of the working set
+func printMemoryTrend(name string, t *MemoryTrend) {
+	if t == nil {
+		return
+	}
+	if t.Verdict == "insufficient" {
+		log.Printf("%s -- RAM trend: too few samples or too short a capture", name)
+		return
+	}
+	limit := ""
+	if t.TimeToLimitSeconds != nil {
+		// a slope near 0 is years away, beyond what time.Duration holds
+		if left := *t.TimeToLimitSeconds; left < maxTimeToLimit.Seconds() {
+			limit = fmt.Sprintf(", the limit reached in %s", time.Duration(left*float64(time.Second)).Round(time.Second))
+		} else {
+			limit = ", the limit reached in more than a year"
+		}
+	}
+	log.Printf("%s -- RAM trend: %+.2f MiB/min, confidence %.2f, %s%s", name, t.SlopeMiBPerMinute, t.Confidence, t.Verdict, limit)
+}
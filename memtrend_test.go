@@ -0,0 +1,127 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// memCapture samples the working set in MiB by f of the second, every interval
+func memCapture(n int, interval time.Duration, f func(s float64) float64) *capture {
+	start := time.Unix(1650000000, 0)
+	series := make([]float64, n)
+	times := make([]int64, n)
+	for i := range series {
+		t := time.Duration(i) * interval
+		series[i] = f(t.Seconds()) * (1 << 20)
+		times[i] = start.Add(t).UnixNano()
+	}
+	return &capture{metrics: []metric{memMetric}, series: [][]float64{series}, times: times}
+}
+
+func TestMemoryTrend(t *testing.T) {
+
+	growing := func(s float64) float64 { return 100 + s/6 }
+	tests := []struct {
+		name    string
+		c       *capture
+		limit   float64
+		verdict string
+		slope   float64
+		// the time to the limit in seconds, -1 for none
+		toLimit float64
+	}{
+		{"leak", memCapture(121, time.Second, growing), 200 << 20, "leak", 10, 480},
+		{"leak without limit", memCapture(121, time.Second, growing), 0, "leak", 10, -1},
+		{"growing over a short run", memCapture(31, time.Second, func(s float64) float64 { return 100 + s/3 }), 200 << 20, "growing", 20, 270},
+		{"capture too short", memCapture(20, 5*time.Millisecond, func(s float64) float64 { return 100 + s*100 }), 200 << 20, "insufficient", 0, -1},
+		{"too few samples", memCapture(5, time.Minute, growing), 200 << 20, "insufficient", 0, -1},
+		{"flat", memCapture(121, time.Second, func(float64) float64 { return 100 }), 200 << 20, "stable", 0, -1},
+		{"spikes", memCapture(121, time.Second, func(s float64) float64 {
+			if int(s)%20 == 0 {
+				return 180
+			}
+			return 100
+		}), 200 << 20, "stable", 0, -1},
+		{"shrinking", memCapture(121, time.Second, func(s float64) float64 { return 100 - s/6 }), 200 << 20, "stable", -10, -1},
+		{"noisy growth", memCapture(121, time.Second, func(s float64) float64 { return 100 + s/600 + math.Sin(s) }), 200 << 20, "stable", 0.1, -1},
+		{"over the limit", memCapture(121, time.Second, growing), 110 << 20, "leak", 10, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trend := memoryTrend(tt.c, 1000, tt.limit)
+			if trend == nil {
+				t.Fatal("memoryTrend() = nil")
+			}
+			if trend.Verdict != tt.verdict || math.Abs(trend.SlopeMiBPerMinute-tt.slope) > 0.05 {
+				t.Errorf("verdict %s, slope %.3f MiB/min, want %s, %.3f", trend.Verdict, trend.SlopeMiBPerMinute, tt.verdict, tt.slope)
+			}
+			if trend.LimitBytes != tt.limit {
+				t.Errorf("limit %v, want %v", trend.LimitBytes, tt.limit)
+			}
+			switch {
+			case tt.toLimit < 0 && trend.TimeToLimitSeconds != nil:
+				t.Errorf("time to limit %v, want none", *trend.TimeToLimitSeconds)
+			case tt.toLimit >= 0 && trend.TimeToLimitSeconds == nil:
+				t.Errorf("no time to limit, want %v", tt.toLimit)
+			case tt.toLimit >= 0 && math.Abs(*trend.TimeToLimitSeconds-tt.toLimit) > 1:
+				t.Errorf("time to limit %v, want %v", *trend.TimeToLimitSeconds, tt.toLimit)
+			}
+		})
+	}
+
+	if trend := memoryTrend(&capture{metrics: []metric{cpuMetric}, series: [][]float64{{1, 2, 3}}}, 1000, 0); trend != nil {
+		t.Errorf("memoryTrend() without RAM = %+v, want nil", trend)
+	}
+}
+
+func TestPrintMemoryTrendFarLimit(t *testing.T) {
+	// a slope near 0 puts the limit beyond what time.Duration holds
+	seconds := 1e12
+	printMemoryTrend("birdy", &MemoryTrend{SlopeMiBPerMinute: 1e-9, Verdict: "growing", TimeToLimitSeconds: &seconds})
+}
+
+func TestReadMemoryLimit(t *testing.T) {
+
+	dir := t.TempDir()
+	tests := []struct {
+		content string
+		limit   float64
+	}{
+		{"1073741824\n", 1 << 30},
+		{"max\n", 0},
+		// cgroup v1 without a limit
+		{"9223372036854771712\n", 0},
+	}
+	for i, tt := range tests {
+		path := filepath.Join(dir, string(rune('a'+i)))
+		if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := readMemoryLimit(path); got != tt.limit {
+			t.Errorf("readMemoryLimit(%q) = %v, want %v", tt.content, got, tt.limit)
+		}
+	}
+	if got := readMemoryLimit(filepath.Join(dir, "missing")); got != 0 {
+		t.Errorf("readMemoryLimit() of a missing file = %v, want 0", got)
+	}
+	if got := readMemoryLimit(""); got != 0 {
+		t.Errorf("readMemoryLimit(\"\") = %v, want 0", got)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The network collector reads /proc/<pid>/net/dev of the network namespace of the target: the bytes, packets,
+// errors, drops, FIFO errors and multicast of every interface matching --iface, a name or a glob. Without
+// --iface, the interface of the default route in /proc/<pid>/net/route is taken.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// netColumn is a metric of the numbers of every interface, after its name in net/dev
+type netColumn struct {
+	column int
+	m      metric
+}
+
+// the receive columns are bytes packets errs drop fifo frame compressed multicast, then the transmit ones
+// bytes packets errs drop fifo colls carrier compressed
+var netColumns = []netColumn{
+	{0, ingressMetric},
+	{8, egressMetric},
+	{1, packetMetric("Received packets", "rx_packets")},
+	{9, packetMetric("Sent packets", "tx_packets")},
+	{2, packetMetric("Receive errors", "rx_errors")},
+	{10, packetMetric("Send errors", "tx_errors")},
+	{3, packetMetric("Receive drops", "rx_drops")},
+	{11, packetMetric("Send drops", "tx_drops")},
+	{4, packetMetric("Receive FIFO errors", "rx_fifo")},
+	{12, packetMetric("Send FIFO errors", "tx_fifo")},
+	{7, packetMetric("Multicast", "rx_multicast")},
+}
+
+func packetMetric(label string, key string) metric {
+	return metric{label, key, key, true, transRate(1000), "packets/s", 1000, nil, nil}
+}
+
+// ifaceMetric is a metric of a single interface, when several of them match
+func ifaceMetric(iface string, m metric) metric {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, iface)
+	m.label = iface + " " + m.label
+	m.file = name + "_" + m.file
+	m.key = name + "_" + m.key
+	return m
+}
+
+// newNetworkCollector reads the sums of the interfaces matching iface, and every one of them if several match
+func newNetworkCollector(pid string, iface string) (collector, error) {
+
+	if iface == "" {
+		detected, err := defaultRouteIface(procPath(pid, "net/route"))
+		if err != nil {
+			return collector{}, err
+		}
+		log.Printf("Network interface of process %s: %s, by the default route", pid, detected)
+		iface = detected
+	}
+
+	path := getNetPath(pid)
+	counters, err := readNetDev(path)
+	if err != nil {
+		return collector{}, fileError(errTarget, err)
+	}
+	var ifaces []string
+	for name := range counters {
+		if ok, _ := filepath.Match(iface, name); ok {
+			ifaces = append(ifaces, name)
+		}
+	}
+	if len(ifaces) == 0 {
+		return collector{}, newError(errTarget, "no info for the network interface %q of process %s", iface, pid)
+	}
+	sort.Strings(ifaces)
+
+	var metrics []metric
+	for _, col := range netColumns {
+		metrics = append(metrics, col.m)
+	}
+	if len(ifaces) > 1 {
+		log.Printf("Network interfaces of process %s: %s", pid, strings.Join(ifaces, ", "))
+		for _, name := range ifaces {
+			for _, col := range netColumns {
+				metrics = append(metrics, ifaceMetric(name, col.m))
+			}
+		}
+	}
+
+	// an interface gone keeps its last numbers, so the sums never go backwards
+	last := counters
+	return collector{
+		metrics: metrics,
+		read: func() ([]float64, error) {
+			counters, err := readNetDev(path)
+			if err != nil {
+				return nil, err
+			}
+			values := make([]float64, len(metrics))
+			for i, name := range ifaces {
+				numbers, ok := counters[name]
+				if ok {
+					last[name] = numbers
+				} else {
+					numbers = last[name]
+				}
+				for j, col := range netColumns {
+					values[j] += numbers[col.column]
+					if len(ifaces) > 1 {
+						values[(i+1)*len(netColumns)+j] = numbers[col.column]
+					}
+				}
+			}
+			return values, nil
+		},
+	}, nil
+}
+
+// readNetDev returns the numbers of every interface in net/dev, after its name
+func readNetDev(path string) (map[string][]float64, error) {
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read statistic file of network: %w", err)
+	}
+	counters := make(map[string][]float64)
+	for _, line := range strings.Split(string(content), "\n") {
+		name, rest, ok := strings.Cut(line, ":")
+		fields := strings.Fields(rest)
+		// the two lines of headers have no colon
+		if !ok || len(fields) < 16 {
+			continue
+		}
+		numbers := make([]float64, len(fields))
+		for i, f := range fields {
+			numbers[i] = stringToFloat(f)
+		}
+		counters[strings.TrimSpace(name)] = numbers
+	}
+	return counters, nil
+}
+
+// defaultRouteIface returns the interface of the default route of IPv4, destination and mask 0.0.0.0
+func defaultRouteIface(path string) (string, error) {
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fileError(errTarget, err)
+	}
+	for _, line := range strings.Split(string(content), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) >= 8 && fields[1] == "00000000" && fields[7] == "00000000" {
+			return fields[0], nil
+		}
+	}
+	return "", newError(errTarget, "no default route in %s, give the network interface by --iface", path)
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeTemp writes a file in a temporary directory and returns its path
+func writeTemp(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadNetDev(t *testing.T) {
+
+	path := writeTemp(t, "dev", `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:    1200      12    0    0    0     0          0         0     1200      12    0    0    0     0       0          0
+  eth0:98765432  123456    1    2    0     0          0         3 12345678   65432    0    4    0     0       0          0
+cali1f4b0c2e3a7:500 5 0 0 0 0 0 0 700 7 0 0 0 0 0 0
+ bad0: 1 2 3
+`)
+	got, err := readNetDev(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]float64{
+		"lo":              {1200, 12, 0, 0, 0, 0, 0, 0, 1200, 12, 0, 0, 0, 0, 0, 0},
+		"eth0":            {98765432, 123456, 1, 2, 0, 0, 0, 3, 12345678, 65432, 0, 4, 0, 0, 0, 0},
+		"cali1f4b0c2e3a7": {500, 5, 0, 0, 0, 0, 0, 0, 700, 7, 0, 0, 0, 0, 0, 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readNetDev() = %v, want %v", got, want)
+	}
+
+	if _, err := readNetDev(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("readNetDev(missing) has no error")
+	}
+}
+
+func TestDefaultRouteIface(t *testing.T) {
+
+	header := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"
+	tests := []struct {
+		name  string
+		route string
+		want  string
+		ok    bool
+	}{
+		{
+			"default route",
+			header +
+				"eth0\t0011A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n" +
+				"eth0\t00000000\t0111A8C0\t0003\t0\t0\t0\t00000000\t0\t0\t0\n",
+			"eth0", true,
+		},
+		{
+			"first default route",
+			header +
+				"wlan0\t00000000\t0101A8C0\t0003\t0\t0\t600\t00000000\t0\t0\t0\n" +
+				"eth0\t00000000\t0111A8C0\t0003\t0\t0\t100\t00000000\t0\t0\t0\n",
+			"wlan0", true,
+		},
+		{
+			"zero destination with a mask",
+			header + "eth0\t00000000\t00000000\t0001\t0\t0\t0\t000000FF\t0\t0\t0\n",
+			"", false,
+		},
+		{"only the header", header, "", false},
+		{"empty", "", "", false},
+	}
+	for _, tt := range tests {
+		got, err := defaultRouteIface(writeTemp(t, "route", tt.route))
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("%s: defaultRouteIface() = %q, %v, want %q, ok %v", tt.name, got, err, tt.want, tt.ok)
+		}
+		if err != nil && exitCode(err) != int(errTarget) {
+			t.Errorf("%s: exit code = %d, want %d", tt.name, exitCode(err), errTarget)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The OTLP/HTTP exporter, enabled by --otlp-endpoint, sends the samples in batches to an OpenTelemetry collector
+// in the JSON encoding of OTLP: gauges for levels like memory, cumulative sums for counters like CPU time.
+// At the end of a run, the distribution of every metric is sent as a histogram.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/montanaflynn/stats"
+)
+
+const (
+	otlpMetricsPath = "/v1/metrics"
+	// the samples buffered between flushes, newer samples are dropped beyond it
+	maxOtlpSamples = 100000
+	// OTLP AggregationTemporality
+	otlpCumulative = 2
+)
+
+// otlpUnits maps the unit of a metric to UCUM units: of its numbers, and of its cumulative counter
+var otlpUnits = map[string][2]string{
+	"millicores":    {"{millicore}", "ms"},
+	"bytes":         {"By", "By"},
+	"bytes/s":       {"By/s", "By"},
+	"percent":       {"%", "cs"},
+	"switches/s":    {"{switch}/s", "{switch}"},
+	"packets/s":     {"{packet}/s", "{packet}"},
+	"connections/s": {"{connection}/s", "{connection}"},
+	"count":         {"1", "1"},
+}
+
+type otlpConfig struct {
+	// the base URL of the collector, /v1/metrics is appended
+	endpoint string
+	interval time.Duration
+	timeout  time.Duration
+}
+
+func (c otlpConfig) validate() error {
+	if !strings.HasPrefix(c.endpoint, "http://") && !strings.HasPrefix(c.endpoint, "https://") {
+		return newError(errUsage, "--otlp-endpoint must be an http or https URL, got %q", c.endpoint)
+	}
+	if c.interval <= 0 {
+		return newError(errUsage, "--otlp-interval must be positive, got %s", c.interval)
+	}
+	return nil
+}
+
+// otlpExporter is the sink of a target sending its samples in batches
+type otlpExporter struct {
+	config   otlpConfig
+	client   *http.Client
+	resource otlpResource
+	metrics  []metric
+	// the span, for turning counters into rates of summaries
+	ms int
+
+	mu      sync.Mutex
+	samples []otlpSample
+	dropped int
+	// counters are sent as sums since the first sample, or since their last reset:
+	// the numbers and the time they start from by metric, and the last numbers read
+	base   []float64
+	starts []time.Time
+	last   []float64
+
+	// serializes the flushes
+	sendMu sync.Mutex
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func newOtlpExporter(config otlpConfig, resource otlpResource, metrics []metric, ms int) *otlpExporter {
+
+	e := &otlpExporter{
+		config:   config,
+		client:   &http.Client{Timeout: config.timeout},
+		resource: resource,
+		metrics:  metrics,
+		ms:       ms,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go func() {
+		defer close(e.done)
+		ticker := time.NewTicker(config.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := e.flush(nil); err != nil {
+					log.Print("Cannot export samples with OTLP: ", err)
+				}
+			case <-e.stop:
+				return
+			}
+		}
+	}()
+
+	log.Printf("Exporting metrics with OTLP to %s every %s", config.endpoint, config.interval)
+	return e
+}
+
+// newOtlpResource describes the target with the semantic conventions of OpenTelemetry
+func newOtlpResource(name string, t Target) otlpResource {
+
+	attrs := []otlpAttribute{
+		stringAttribute("service.name", "colibri"),
+		stringAttribute("k8s.container.name", name),
+		stringAttribute("k8s.node.name", nodeName()),
+		intAttribute("process.pid", int64(t.Pid)),
+		intAttribute("colibri.cgroup.version", cgroupVersion),
+		stringAttribute("colibri.source", t.Source),
+	}
+	if t.Namespace != "" {
+		attrs = append(attrs, stringAttribute("k8s.namespace.name", t.Namespace))
+	}
+	if t.Pod != "" {
+		attrs = append(attrs, stringAttribute("k8s.pod.name", t.Pod))
+	}
+	if t.Command != "" {
+		attrs = append(attrs, stringAttribute("process.command_line", t.Command))
+	}
+	return otlpResource{attrs}
+}
+
+// otlpSample is a sample with its counters since their start
+type otlpSample struct {
+	sample
+	// the start of every counter, shared by the samples until a reset
+	starts []time.Time
+}
+
+func (e *otlpExporter) observe(t time.Time, values []float64) {
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.last == nil {
+		e.base = append([]float64(nil), values...)
+		e.starts = make([]time.Time, len(values))
+		for i := range e.starts {
+			e.starts[i] = t
+		}
+	}
+	for i, m := range e.metrics {
+		// a cumulative sum never decreases, a counter going backwards starts a new one from here
+		if m.counter && e.last != nil && values[i] < e.last[i] {
+			e.starts = append([]time.Time(nil), e.starts...)
+			e.starts[i], e.base[i] = t, values[i]
+		}
+	}
+	e.last = append(e.last[:0], values...)
+
+	if len(e.samples) >= maxOtlpSamples {
+		e.dropped++
+		return
+	}
+	s := otlpSample{sample{t, append([]float64(nil), values...)}, e.starts}
+	for i, m := range e.metrics {
+		if m.counter {
+			s.values[i] -= e.base[i]
+		}
+	}
+	e.samples = append(e.samples, s)
+}
+
+// flush sends the buffered samples, and the summaries of the run if c is given
+func (e *otlpExporter) flush(c *capture) error {
+
+	e.sendMu.Lock()
+	defer e.sendMu.Unlock()
+
+	e.mu.Lock()
+	samples, dropped := e.samples, e.dropped
+	e.samples, e.dropped = nil, 0
+	e.mu.Unlock()
+
+	if dropped > 0 {
+		log.Printf("Dropped %d samples of OTLP export, the collector is too slow", dropped)
+	}
+	if len(samples) == 0 && c == nil {
+		return nil
+	}
+
+	var metrics []otlpMetric
+	if len(samples) > 0 {
+		metrics = e.sampleMetrics(samples)
+	}
+	if c != nil {
+		metrics = append(metrics, e.summaryMetrics(c)...)
+	}
+	return e.send(metrics)
+}
+
+// close stops the periodic flushes, then sends the rest of samples and the summaries of the run
+func (e *otlpExporter) close(c *capture) error {
+
+	close(e.stop)
+	<-e.done
+
+	if err := e.flush(c); err != nil {
+		return &Error{errApi, fmt.Errorf("cannot export metrics with OTLP: %w", err)}
+	}
+	return nil
+}
+
+func (e *otlpExporter) sampleMetrics(samples []otlpSample) []otlpMetric {
+
+	var metrics []otlpMetric
+	for i, m := range e.metrics {
+		units := otlpUnits[m.unitName]
+		om := otlpMetric{Name: "colibri." + m.key}
+
+		points := make([]otlpNumberPoint, len(samples))
+		for j, s := range samples {
+			points[j].TimeUnixNano = unixNano(s.t)
+			if m.counter {
+				// the scale turns rates per millisecond into the unit, so a thousandth of it turns counts into the unit times second
+				points[j].StartTimeUnixNano = unixNano(s.starts[i])
+				points[j].AsDouble = s.values[i] * m.scale / 1000
+			} else {
+				points[j].AsDouble = s.values[i] * m.scale
+			}
+		}
+
+		if m.counter {
+			om.Unit = units[1]
+			om.Description = fmt.Sprintf("The cumulative %s of the target since the first sample or the last reset", m.label)
+			om.Sum = &otlpSum{points, otlpCumulative, true}
+		} else {
+			om.Unit = units[0]
+			om.Description = fmt.Sprintf("The %s of the target", m.label)
+			om.Gauge = &otlpGauge{points}
+		}
+		metrics = append(metrics, om)
+	}
+	return metrics
+}
+
+// summaryMetrics builds a histogram of every metric over the run,
+// bucketed by the percentiles of the result document so they can be read back
+func (e *otlpExporter) summaryMetrics(c *capture) []otlpMetric {
+
+	var metrics []otlpMetric
+
+	for i, m := range c.metrics {
+		values, _ := scaledValues(m, c.series[i], e.ms)
+		if len(values) == 0 || trendOnly(m) {
+			continue
+		}
+
+		var bounds []float64
+		for _, p := range defaultPercentiles {
+			b, _ := stats.Percentile(values, p)
+			if len(bounds) == 0 || b > bounds[len(bounds)-1] {
+				bounds = append(bounds, b)
+			}
+		}
+
+		counts := make([]uint64, len(bounds)+1)
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+			counts[sort.SearchFloat64s(bounds, v)]++
+		}
+		min, _ := stats.Min(values)
+		max, _ := stats.Max(values)
+
+		point := otlpHistogramPoint{
+			StartTimeUnixNano: unixNano(c.start),
+			TimeUnixNano:      unixNano(c.end),
+			Count:             strconv.Itoa(len(values)),
+			Sum:               sum,
+			Min:               min,
+			Max:               max,
+			ExplicitBounds:    bounds,
+		}
+		for _, n := range counts {
+			point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(n, 10))
+		}
+
+		metrics = append(metrics, otlpMetric{
+			Name:        "colibri.run." + m.key,
+			Description: fmt.Sprintf("The distribution of %s over the run", m.label),
+			Unit:        otlpUnits[m.unitName][0],
+			Histogram:   &otlpHistogram{[]otlpHistogramPoint{point}, otlpCumulative},
+		})
+	}
+	return metrics
+}
+
+func (e *otlpExporter) send(metrics []otlpMetric) error {
+
+	body, err := json.Marshal(otlpRequest{[]otlpResourceMetrics{{
+		Resource:     e.resource,
+		ScopeMetrics: []otlpScopeMetrics{{otlpScope{"colibri"}, metrics}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Post(strings.TrimSuffix(e.config.endpoint, "/")+otlpMetricsPath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("collector responds %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// The JSON encoding of OTLP ExportMetricsServiceRequest, 64-bit integers are strings
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpAttribute struct {
+	Key   string             `json:"key"`
+	Value otlpAttributeValue `json:"value"`
+}
+
+type otlpAttributeValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{key, otlpAttributeValue{StringValue: &value}}
+}
+
+func intAttribute(key string, value int64) otlpAttribute {
+	v := strconv.FormatInt(value, 10)
+	return otlpAttribute{key, otlpAttributeValue{IntValue: &v}}
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Unit        string         `json:"unit"`
+	Gauge       *otlpGauge     `json:"gauge,omitempty"`
+	Sum         *otlpSum       `json:"sum,omitempty"`
+	Histogram   *otlpHistogram `json:"histogram,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberPoint `json:"dataPoints"`
+	AggregationTemporality int               `json:"aggregationTemporality"`
+	IsMonotonic            bool              `json:"isMonotonic"`
+}
+
+type otlpNumberPoint struct {
+	StartTimeUnixNano string  `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string  `json:"timeUnixNano"`
+	AsDouble          float64 `json:"asDouble"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramPoint `json:"dataPoints"`
+	AggregationTemporality int                  `json:"aggregationTemporality"`
+}
+
+type otlpHistogramPoint struct {
+	StartTimeUnixNano string    `json:"startTimeUnixNano"`
+	TimeUnixNano      string    `json:"timeUnixNano"`
+	Count             string    `json:"count"`
+	Sum               float64   `json:"sum"`
+	Min               float64   `json:"min"`
+	Max               float64   `json:"max"`
+	BucketCounts      []string  `json:"bucketCounts"`
+	ExplicitBounds    []float64 `json:"explicitBounds"`
+}
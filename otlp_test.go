@@ -0,0 +1,234 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// otlpCollector is a stub OpenTelemetry collector keeping the requests it receives
+type otlpCollector struct {
+	*httptest.Server
+	requests []otlpRequest
+	bodies   []string
+}
+
+func newOtlpCollector(t *testing.T) *otlpCollector {
+	c := &otlpCollector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != otlpMetricsPath {
+			t.Errorf("request %s %s, want POST %s", r.Method, r.URL.Path, otlpMetricsPath)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("content type %q, want application/json", ct)
+		}
+		body, _ := io.ReadAll(r.Body)
+		var req otlpRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Errorf("malformed request: %v", err)
+		}
+		c.requests = append(c.requests, req)
+		c.bodies = append(c.bodies, string(body))
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+// find returns the metric of the name in the requests, by the order received
+func (c *otlpCollector) find(name string) []otlpMetric {
+	var found []otlpMetric
+	for _, req := range c.requests {
+		for _, rm := range req.ResourceMetrics {
+			for _, sm := range rm.ScopeMetrics {
+				for _, m := range sm.Metrics {
+					if m.Name == name {
+						found = append(found, m)
+					}
+				}
+			}
+		}
+	}
+	return found
+}
+
+func TestOtlpExport(t *testing.T) {
+
+	collector := newOtlpCollector(t)
+	metrics := []metric{egressMetric, memMetric}
+	// a trailing slash of the endpoint is not doubled
+	config := otlpConfig{endpoint: collector.URL + "/", interval: time.Hour, timeout: time.Second}
+	resource := newOtlpResource("app", Target{Pid: 42, Namespace: "default", Pod: "web", Source: "cgroup"})
+	e := newOtlpExporter(config, resource, metrics, 1000)
+
+	start := time.Unix(1650000000, 0)
+	egress := []float64{0, 1000, 3000, 6000, 10000}
+	mem := []float64{100, 200, 300, 400, 500}
+	c := &capture{metrics: metrics, series: [][]float64{egress, mem}, start: start, end: start.Add(4 * time.Second)}
+	for i := range egress {
+		e.observe(start.Add(time.Duration(i)*time.Second), []float64{egress[i], mem[i]})
+	}
+	if err := e.close(c); err != nil {
+		t.Fatal(err)
+	}
+	if len(collector.requests) != 1 {
+		t.Fatalf("received %d requests, want 1", len(collector.requests))
+	}
+
+	// the field names of the JSON encoding of OTLP, which decoding into the same structs would not catch
+	for _, field := range []string{`"resourceMetrics":[`, `"scopeMetrics":[`, `"scope":{"name":"colibri"}`,
+		`"key":"process.pid","value":{"intValue":"42"}`, `"aggregationTemporality":2,"isMonotonic":true`,
+		`"startTimeUnixNano":"1650000000000000000","timeUnixNano":"1650000001000000000","asDouble":1000`,
+		`"bucketCounts":["2","1","1"],"explicitBounds":[2000,3500]`} {
+		if !strings.Contains(collector.bodies[0], field) {
+			t.Errorf("request has no %s", field)
+		}
+	}
+
+	attrs := map[string]otlpAttributeValue{}
+	for _, a := range collector.requests[0].ResourceMetrics[0].Resource.Attributes {
+		attrs[a.Key] = a.Value
+	}
+	for key, want := range map[string]string{"service.name": "colibri", "k8s.container.name": "app", "k8s.namespace.name": "default", "k8s.pod.name": "web"} {
+		if v := attrs[key].StringValue; v == nil || *v != want {
+			t.Errorf("attribute %s = %v, want %q", key, v, want)
+		}
+	}
+	if v := attrs["process.pid"].IntValue; v == nil || *v != "42" {
+		t.Errorf("attribute process.pid = %v, want \"42\"", v)
+	}
+
+	sums := collector.find("colibri.egress")
+	if len(sums) != 1 || sums[0].Sum == nil || sums[0].Gauge != nil {
+		t.Fatalf("egress = %+v, want one sum", sums)
+	}
+	sum := sums[0].Sum
+	if !sum.IsMonotonic || sum.AggregationTemporality != otlpCumulative || sums[0].Unit != "By" {
+		t.Errorf("egress is monotonic %v, temporality %d, unit %q, want a monotonic cumulative sum in By",
+			sum.IsMonotonic, sum.AggregationTemporality, sums[0].Unit)
+	}
+	for i, p := range sum.DataPoints {
+		if p.AsDouble != egress[i] || p.StartTimeUnixNano != unixNano(start) || p.TimeUnixNano != unixNano(start.Add(time.Duration(i)*time.Second)) {
+			t.Errorf("egress point %d = %+v, want %v since the start", i, p, egress[i])
+		}
+	}
+
+	gauges := collector.find("colibri.ram")
+	if len(gauges) != 1 || gauges[0].Gauge == nil || gauges[0].Unit != "By" {
+		t.Fatalf("ram = %+v, want one gauge in By", gauges)
+	}
+	for i, p := range gauges[0].Gauge.DataPoints {
+		if p.AsDouble != mem[i] || p.StartTimeUnixNano != "" {
+			t.Errorf("ram point %d = %+v, want %v without a start time", i, p, mem[i])
+		}
+	}
+
+	histograms := collector.find("colibri.run.egress")
+	if len(histograms) != 1 || histograms[0].Histogram == nil || histograms[0].Unit != "By/s" {
+		t.Fatalf("run.egress = %+v, want one histogram in By/s", histograms)
+	}
+	h := histograms[0].Histogram.DataPoints[0]
+	// the rates are 1000, 2000, 3000 and 4000 bytes/s, bucketed by their percentiles
+	want := otlpHistogramPoint{
+		StartTimeUnixNano: unixNano(start),
+		TimeUnixNano:      unixNano(start.Add(4 * time.Second)),
+		Count:             "4",
+		Sum:               10000,
+		Min:               1000,
+		Max:               4000,
+		// p50 of 2000, p90 to p99 of 3500 as repeated bounds are merged
+		ExplicitBounds: []float64{2000, 3500},
+		// upper bounds are inclusive, the maximum falls in the overflow bucket
+		BucketCounts: []string{"2", "1", "1"},
+	}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("run.egress = %+v, want %+v", h, want)
+	}
+}
+
+func TestOtlpCollectorFailure(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	config := otlpConfig{endpoint: srv.URL, interval: time.Hour, timeout: time.Second}
+	e := newOtlpExporter(config, otlpResource{}, []metric{memMetric}, 1000)
+	e.observe(time.Now(), []float64{1})
+	err := e.close(nil)
+	if err == nil {
+		t.Fatal("close() succeeds against a failing collector")
+	}
+	if code := exitCode(err); code != int(errApi) {
+		t.Errorf("exit code = %d, want %d", code, errApi)
+	}
+}
+
+func TestOtlpCounterReset(t *testing.T) {
+
+	collector := newOtlpCollector(t)
+	config := otlpConfig{endpoint: collector.URL, interval: time.Hour, timeout: time.Second}
+	e := newOtlpExporter(config, otlpResource{}, []metric{egressMetric, memMetric}, 1000)
+
+	start := time.Unix(1650000000, 0)
+	at := func(i int) time.Time { return start.Add(time.Duration(i) * time.Second) }
+	// the target restarts after the third sample, the counter starts over while the gauge goes down as well
+	egress := []float64{500, 1500, 3500, 200, 700}
+	mem := []float64{300, 400, 500, 100, 200}
+	for i := range egress {
+		e.observe(at(i), []float64{egress[i], mem[i]})
+		if i == 1 {
+			// the sums go on across flushes
+			if err := e.flush(nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := e.close(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var points []otlpNumberPoint
+	for _, m := range collector.find("colibri.egress") {
+		points = append(points, m.Sum.DataPoints...)
+	}
+	want := []otlpNumberPoint{
+		{unixNano(at(0)), unixNano(at(0)), 0},
+		{unixNano(at(0)), unixNano(at(1)), 1000},
+		{unixNano(at(0)), unixNano(at(2)), 3000},
+		{unixNano(at(3)), unixNano(at(3)), 0},
+		{unixNano(at(3)), unixNano(at(4)), 500},
+	}
+	if !reflect.DeepEqual(points, want) {
+		t.Errorf("egress = %+v, want %+v", points, want)
+	}
+
+	var gauges []float64
+	for _, m := range collector.find("colibri.ram") {
+		for _, p := range m.Gauge.DataPoints {
+			gauges = append(gauges, p.AsDouble)
+		}
+	}
+	if !reflect.DeepEqual(gauges, mem) {
+		t.Errorf("ram = %v, want %v untouched", gauges, mem)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+)
+
+// liveOutputs are the exporters and writers receiving every sample of a run, given by the flags
+type liveOutputs struct {
+	o    *options
+	prom *promExporter
+
+	otlp []otlpGroup
+	// writers of raw samples
+	writers []*batchSink
+}
+
+// otlpGroup is the OTLP exporter of a part of the metrics
+type otlpGroup struct {
+	exporter  *otlpExporter
+	offset, n int
+}
+
+func newLiveOutputs(o *options) (*liveOutputs, error) {
+
+	out := &liveOutputs{o: o}
+	if o.listen != "" {
+		out.prom = newPromExporter(o.window, o.pert)
+		if err := out.prom.serve(o.listen); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// attach creates the sinks of the metrics from offset, which are the numbers of the target.
+// The sinks are given the whole values, and pick up their part.
+func (out *liveOutputs) attach(target Target, metrics []metric, offset int, total int) ([]sink, error) {
+
+	o := out.o
+	var sinks []sink
+
+	if out.prom != nil {
+		sinks = append(sinks, out.prom.attach(promLabels(o.name, target), metrics))
+	}
+	if o.otlp.endpoint != "" {
+		exporter := newOtlpExporter(o.otlp, newOtlpResource(o.name, target), metrics, o.span)
+		out.otlp = append(out.otlp, otlpGroup{exporter, offset, len(metrics)})
+		sinks = append(sinks, exporter)
+	}
+	if o.influx != "" {
+		w, err := newInfluxWriter(o.influx, o.influxToken, batchTimeout, target.labels(o.name), metrics)
+		if err != nil {
+			return nil, err
+		}
+		b := newBatchSink("InfluxDB", w, o.batch)
+		out.writers = append(out.writers, b)
+		sinks = append(sinks, b)
+	}
+	if o.remoteWrite != "" {
+		b := newBatchSink("Prometheus remote-write", newRemoteWriter(o.remoteWrite, batchTimeout, target.labels(o.name), metrics), o.batch)
+		out.writers = append(out.writers, b)
+		sinks = append(sinks, b)
+	}
+
+	if len(metrics) == total {
+		return sinks, nil
+	}
+	for i, sk := range sinks {
+		sinks[i] = sliceSink{sk, offset, len(metrics)}
+	}
+	return sinks, nil
+}
+
+// closeWriters writes the queued samples once the sampling stops
+func (out *liveOutputs) closeWriters() {
+	for _, w := range out.writers {
+		if err := w.close(); err != nil {
+			log.Printf("Failed writing samples to %s: %v", w.name, err)
+		}
+	}
+}
+
+// closeOtlp sends the rest of samples and the summaries of the run
+func (out *liveOutputs) closeOtlp(c *capture) error {
+	for _, g := range out.otlp {
+		if err := g.exporter.close(c.slice(g.offset, g.n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -26,19 +26,18 @@ import (
 )
 
 const (
+	CpuDirectory  = "cpu,cpuacct"
+	MemDirectory  = "memory"
+	PidsDirectory = "pids"
+)
 
+var (
 	// cgroup_path = "/sys/fs/cgroups/" could be replaced by below
 	// To avoid mixing host's data to container(scraper)'s data, we will mount host data to /tmp
-	PidCgroupPath        = "/tmp/proc/{pid}/cgroup" //comes out the full path of CPU and RAM
-	NetMetricsPath       = "/tmp/proc/{pid}/net/dev"
-	CgroupFilesystemDir  = "/tmp/cgroup"
-	CgroupFilesystemPath = CgroupFilesystemDir + "/"
-
-	CpuDirectory = "cpu,cpuacct"
-	MemDirectory = "memory"
-)
+	// In host mode, both are pointed to the filesystems of the host directly
+	ProcDir             = "/tmp/proc"
+	CgroupFilesystemDir = "/tmp/cgroup"
 
-var (
 	cgroupFd     int = -1
 	prepOnce     sync.Once
 	prepErr      error
@@ -48,10 +47,13 @@ var (
 func openCpuFileV2(pid string) (*os.File, error) {
 	// referring to the implementation of opencontainers/runc/libcontainer/cgroups/file.go
 
-	path := getCpuPathV2(pid)
+	path, err := getCpuPathV2(pid)
+	if err != nil {
+		return nil, err
+	}
 	mode := os.FileMode(0)
 
-	trimPath := strings.TrimPrefix(path, CgroupFilesystemPath)
+	trimPath := strings.TrimPrefix(path, CgroupFilesystemDir+"/")
 	if prepareOpenat2() != nil {
 		log.Print("Warn: prepare for Openat2 error: ", prepErr)
 		return nil, prepErr
@@ -65,7 +67,7 @@ func openCpuFileV2(pid string) (*os.File, error) {
 	if err != nil {
 		err = &os.PathError{Op: "openat2", Path: path, Err: err}
 		fdStr := strconv.Itoa(cgroupFd)
-		fdDest, _ := os.Readlink("/tmp/proc/self/fd/" + fdStr)
+		fdDest, _ := os.Readlink(ProcDir + "/self/fd/" + fdStr)
 		if fdDest != CgroupFilesystemDir {
 			err = fmt.Errorf("cgroupFd %s unexpectedly opened to %s != %s: %w",
 				fdStr, fdDest, CgroupFilesystemDir, err)
@@ -75,82 +77,188 @@ func openCpuFileV2(pid string) (*os.File, error) {
 	return os.NewFile(uintptr(fd), path), nil
 }
 
-func getCgroupMetricPath(cgroupPath string, keyword string) string {
+// referring to the implementation of opencontainers/runc/libcontainer/cgroups/file.go
+func prepareOpenat2() error {
+	prepOnce.Do(func() {
+		fd, err := unix.Openat2(-1, CgroupFilesystemDir, &unix.OpenHow{
+			Flags: unix.O_DIRECTORY | unix.O_PATH | unix.O_CLOEXEC,
+		})
+		if err != nil {
+			prepErr = &os.PathError{Op: "openat2", Path: CgroupFilesystemDir, Err: err}
+			return
+		}
+		var st unix.Statfs_t
+		if err = unix.Fstatfs(fd, &st); err != nil {
+			prepErr = &os.PathError{Op: "statfs", Path: CgroupFilesystemDir, Err: err}
+			unix.Close(fd)
+			return
+		}
+
+		cgroupFd = fd
+
+		resolveFlags = unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS
+		if st.Type == unix.CGROUP2_SUPER_MAGIC {
+			// cgroupv2 has a single mountpoint and no "cpu,cpuacct" symlinks
+			resolveFlags |= unix.RESOLVE_NO_XDEV | unix.RESOLVE_NO_SYMLINKS
+		}
+	})
+
+	return prepErr
+}
+
+// procPath returns the path of a file under the process directory of pid
+func procPath(pid string, name string) string {
+	return ProcDir + "/" + pid + "/" + name
+}
+
+func getCgroupMetricPath(cgroupPath string, keyword string) (string, error) {
 
 	content, err := os.ReadFile(cgroupPath)
 
 	if err != nil {
-		log.Print("Cannot read cgroup metric path: ", err)
+		return "", fileError(errTarget, fmt.Errorf("cannot read cgroup metric path: %w", err))
 	} else if len(keyword) == 0 {
-		// v2: return the first line, since it is the only line
+		// v2: return the line of unified hierarchy "0::", it is the only line unless on a hybrid host
 		// remove all /../ relative path
-		path := strings.TrimSpace(strings.Split(string(content), ":")[2])
-		for strings.HasPrefix(path, "/..") {
-			path = path[3:]
+		for _, line := range strings.Split(string(content), "\n") {
+			if !strings.HasPrefix(line, "0::") {
+				continue
+			}
+			path := strings.TrimSpace(line[3:])
+			for strings.HasPrefix(path, "/..") {
+				path = path[3:]
+			}
+			return path, nil
 		}
-		return path
 
 	} else {
 		for _, path := range strings.Split(string(content), "\n") {
 			if strings.Contains(path, keyword) {
-				return strings.Split(path, ":")[2]
+				return strings.Split(path, ":")[2], nil
 			}
 		}
 	}
-	return ""
+	return "", nil
 
 }
 
-func getCpuPath(pid string) string {
+func getCpuPath(pid string) (string, error) {
 
-	path := getCgroupMetricPath(strings.Replace(PidCgroupPath, "{pid}", pid, 1), CpuDirectory)
+	path, err := getCgroupMetricPath(procPath(pid, "cgroup"), CpuDirectory)
 
+	if err != nil {
+		return "", err
+	}
 	if path == "" {
-		log.Fatal("Error: (cgroup v1) failed to find the path of CPU data\n")
+		return "", newError(errCgroup, "(cgroup v1) failed to find the path of CPU data of process %s", pid)
 	}
 
-	return CgroupFilesystemPath + CpuDirectory + path + "/cpuacct.usage"
+	return cpuFile(path), nil
 }
 
-func getCpuPathV2(pid string) string {
+func getCpuPathV2(pid string) (string, error) {
 
-	path := getCgroupMetricPath(strings.Replace(PidCgroupPath, "{pid}", pid, 1), "")
+	path, err := getCgroupMetricPath(procPath(pid, "cgroup"), "")
 
+	if err != nil {
+		return "", err
+	}
 	if path == "" {
-		log.Fatal("Error: (cgroup v2) failed to find the path of CPU data\n")
+		return "", newError(errCgroup, "(cgroup v2) failed to find the path of CPU data of process %s", pid)
 	}
 
-	return CgroupFilesystemDir + path + "/cpu.stat"
+	return cpuFileV2(path), nil
 }
 
-func getMemPath(pid string) (string, string) {
+func getMemPath(pid string) (string, string, error) {
 
-	path := getCgroupMetricPath(strings.Replace(PidCgroupPath, "{pid}", pid, 1), MemDirectory)
+	path, err := getCgroupMetricPath(procPath(pid, "cgroup"), MemDirectory)
 
+	if err != nil {
+		return "", "", err
+	}
 	if path == "" {
-		log.Fatal("Error: failed to find the path of Memory data\n")
+		return "", "", newError(errCgroup, "(cgroup v1) failed to find the path of Memory data of process %s", pid)
 	}
 
-	return CgroupFilesystemPath + MemDirectory + path + "/memory.usage_in_bytes",
-		CgroupFilesystemPath + MemDirectory + path + "/memory.stat"
-
+	usage, stats := memFiles(path)
+	return usage, stats, nil
 }
 
-func getMemPathV2(pid string) (string, string) {
+func getMemPathV2(pid string) (string, string, error) {
 
-	path := getCgroupMetricPath(strings.Replace(PidCgroupPath, "{pid}", pid, 1), "")
+	path, err := getCgroupMetricPath(procPath(pid, "cgroup"), "")
 
+	if err != nil {
+		return "", "", err
+	}
 	if path == "" {
-		log.Fatal("Error: failed to find the path of Memory data\n")
+		return "", "", newError(errCgroup, "(cgroup v2) failed to find the path of Memory data of process %s", pid)
+	}
+
+	usage, stats := memFilesV2(path)
+	return usage, stats, nil
+}
+
+// cpuFile returns the CPU usage file of the cgroup path, relative to the hierarchy (cgroup v1)
+func cpuFile(path string) string {
+	return CgroupFilesystemDir + "/" + CpuDirectory + path + "/cpuacct.usage"
+}
+
+func cpuFileV2(path string) string {
+	return CgroupFilesystemDir + path + "/cpu.stat"
+}
+
+// memFiles returns the memory usage and statistic files of the cgroup path, relative to the hierarchy (cgroup v1)
+func memFiles(path string) (string, string) {
+	return CgroupFilesystemDir + "/" + MemDirectory + path + "/memory.usage_in_bytes",
+		CgroupFilesystemDir + "/" + MemDirectory + path + "/memory.stat"
+}
+
+func memFilesV2(path string) (string, string) {
+	return CgroupFilesystemDir + path + "/memory.current",
+		CgroupFilesystemDir + path + "/memory.stat"
+}
+
+// getCgroupDir returns the CPU controller directory of the process (cgroup v1),
+// or an empty string if it stays in the root cgroup
+func getCgroupDir(pid string) (string, error) {
+
+	path, err := getCgroupMetricPath(procPath(pid, "cgroup"), CpuDirectory)
+
+	if err != nil || path == "" || path == "/" {
+		return "", err
+	}
+
+	return CgroupFilesystemDir + "/" + CpuDirectory + path, nil
+}
+
+// getPidsDir returns the pids controller directory of the process (cgroup v1),
+// or an empty string if it stays in the root cgroup
+func getPidsDir(pid string) (string, error) {
+
+	path, err := getCgroupMetricPath(procPath(pid, "cgroup"), PidsDirectory)
+
+	if err != nil || path == "" || path == "/" {
+		return "", err
 	}
 
-	return CgroupFilesystemPath + path + "/memory.current",
-		CgroupFilesystemPath + path + "/memory.stat"
+	return CgroupFilesystemDir + "/" + PidsDirectory + path, nil
+}
+
+func getCgroupDirV2(pid string) (string, error) {
+
+	path, err := getCgroupMetricPath(procPath(pid, "cgroup"), "")
+
+	if err != nil || path == "" || path == "/" {
+		return "", err
+	}
 
+	return CgroupFilesystemDir + path, nil
 }
 
 func getNetPath(pid string) string {
 	//cgroup v1 and v2 use the same path for network numbers
-	return strings.Replace(NetMetricsPath, "{pid}", pid, 1)
+	return procPath(pid, "net/dev")
 
 }
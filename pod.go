@@ -0,0 +1,137 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Pod mode, enabled by --pod, profiles the whole Pod of the process given by --pid: the Pod cgroup,
+// the kubepods-*-pod<uid>.slice parent of the container, as the aggregate, and every container
+// in it as the breakdown, all sampled on the same tick.
+
+import (
+	"path"
+	"strconv"
+	"strings"
+)
+
+// podInfo is the Pod cgroup of a target and its containers
+type podInfo struct {
+	path       string
+	uid        string
+	qosClass   string
+	containers []containerInfo
+}
+
+// resolvePod finds the Pod cgroup of the container process pid
+func resolvePod(pid string) (*podInfo, error) {
+
+	dir, err := getCgroupDirOf(pid)
+	if err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		return nil, newError(errCgroup, "process %s stays in the root cgroup, not in a Pod", pid)
+	}
+
+	containerPath := strings.TrimPrefix(dir, cgroupHierarchy())
+	podPath := path.Dir(containerPath)
+	m := podDirRegexp.FindStringSubmatch(path.Base(podPath))
+	if m == nil {
+		return nil, newError(errCgroup, "the cgroup %s of process %s is not in a Pod", containerPath, pid)
+	}
+
+	pod := &podInfo{
+		path:       podPath,
+		uid:        strings.ReplaceAll(m[1], "_", "-"),
+		qosClass:   qosClassOf(podPath),
+		containers: podContainers(podPath, m[1]),
+	}
+	return pod, nil
+}
+
+// newPodCollectors reads the Pod cgroup as the aggregate, then the containers in it.
+// The network is shared by the containers of a Pod, so it is read for the aggregate only.
+func (s Scraper) newPodCollectors(pod *podInfo, metricType string, iface string) ([]collector, error) {
+
+	var ctors []func(path string) (collector, error)
+	cpu := newCgroupCpuCollectorAt
+	mem := newCgroupMemoryCollectorAt
+
+	switch metricType {
+	case "cpu":
+		ctors = append(ctors, cpu)
+	case "mem":
+		ctors = append(ctors, mem)
+	case "net":
+	case "all":
+		ctors = append(ctors, cpu, mem)
+	default:
+		return nil, newError(errUsage, "metric type %q is not supported in Pod mode", metricType)
+	}
+
+	var collectors []collector
+	for _, ctor := range ctors {
+		c, err := ctor(pod.path)
+		if err != nil {
+			return nil, err
+		}
+		collectors = append(collectors, c)
+	}
+	if metricType == "net" || metricType == "all" {
+		c, err := newNetworkCollector(s.pid, iface)
+		if err != nil {
+			return nil, err
+		}
+		collectors = append(collectors, c)
+	}
+
+	for i := range pod.containers {
+		info := &pod.containers[i]
+		for _, ctor := range ctors {
+			c, err := ctor(info.path)
+			if err != nil {
+				return nil, err
+			}
+			// the metrics of containers are told apart in outputs by their containers
+			metrics := make([]metric, len(c.metrics))
+			for j, m := range c.metrics {
+				m.container = info
+				m.file = shortId(info.containerId) + "_" + m.file
+				metrics[j] = m
+			}
+			c.metrics = metrics
+			collectors = append(collectors, c)
+		}
+	}
+	return collectors, nil
+}
+
+// containerName names a container in the log by its command, or its short ID
+func containerName(c *containerInfo) string {
+	if c.command != "" {
+		return c.command + "@" + shortId(c.containerId)
+	}
+	return shortId(c.containerId)
+}
+
+// displayName names the numbers of a metric in the log: the work name, and the container in Pod mode
+// or the process of one of several targets
+func displayName(name string, m metric) string {
+	switch {
+	case m.container != nil:
+		return name + "/" + containerName(m.container)
+	case m.target != nil:
+		return name + "/" + strconv.Itoa(m.target.Pid)
+	}
+	return name
+}
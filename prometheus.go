@@ -0,0 +1,254 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The Prometheus exposition endpoint, enabled by --listen, exposes the current numbers of every target,
+// and the max and percentile over a rolling window of fine-grained samples. A normal 15s scrape
+// thereby still captures the sub-second peaks, e.g. max CPU over the last 1s computed from 5ms samples.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/montanaflynn/stats"
+)
+
+const promContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type promExporter struct {
+	// the length of the rolling window
+	window time.Duration
+	// the percentile computed over the window
+	pert float64
+
+	mu      sync.Mutex
+	targets []*promTarget
+}
+
+// promTarget is the sink of a target, holding the rolling windows of its metrics
+type promTarget struct {
+	labels  string
+	metrics []metric
+	samples uint64
+
+	// the last raw numbers, for turning counters into rates
+	lastTime   time.Time
+	lastValues []float64
+
+	current []float64
+	windows []rollingWindow
+	// shared with the exporter
+	mu     *sync.Mutex
+	length time.Duration
+}
+
+// rollingWindow keeps the numbers of the last period, oldest first
+type rollingWindow struct {
+	times  []time.Time
+	values []float64
+}
+
+func (w *rollingWindow) add(t time.Time, v float64, length time.Duration) {
+	w.times = append(w.times, t)
+	w.values = append(w.values, v)
+
+	// drop the expired head, and compact when half of the buffer is garbage
+	cut := 0
+	for cut < len(w.times) && t.Sub(w.times[cut]) > length {
+		cut++
+	}
+	w.times = w.times[cut:]
+	w.values = w.values[cut:]
+	if cap(w.times) > 2*len(w.times)+64 {
+		w.times = append([]time.Time(nil), w.times...)
+		w.values = append([]float64(nil), w.values...)
+	}
+}
+
+func newPromExporter(window time.Duration, pert float64) *promExporter {
+	return &promExporter{window: window, pert: pert}
+}
+
+// promLabels renders the identity of a target as Prometheus labels
+func promLabels(name string, t Target) string {
+	var labels []string
+	for _, l := range t.labels(name) {
+		labels = append(labels, l[0]+`="`+promEscape(l[1])+`"`)
+	}
+	return strings.Join(labels, ",")
+}
+
+func promEscape(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// attach returns the sink of a target with the metrics
+func (e *promExporter) attach(labels string, metrics []metric) sink {
+
+	t := &promTarget{
+		labels:  labels,
+		metrics: metrics,
+		current: make([]float64, len(metrics)),
+		windows: make([]rollingWindow, len(metrics)),
+		mu:      &e.mu,
+		length:  e.window,
+	}
+
+	e.mu.Lock()
+	e.targets = append(e.targets, t)
+	e.mu.Unlock()
+	return t
+}
+
+// detach stops exposing the target of a sink returned by attach, e.g. the container is gone
+func (e *promExporter) detach(sk sink) {
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for i, t := range e.targets {
+		if t == sk {
+			e.targets = append(e.targets[:i], e.targets[i+1:]...)
+			return
+		}
+	}
+}
+
+func (t *promTarget) observe(now time.Time, values []float64) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.samples++
+	for i, m := range t.metrics {
+		v := values[i]
+		if m.counter {
+			if t.lastValues == nil {
+				continue
+			}
+			// counters are turned into rates with the actual elapsed time rather than the span
+			elapsed := float64(now.Sub(t.lastTime)) / float64(time.Millisecond)
+			if elapsed <= 0 {
+				continue
+			}
+			v = (values[i] - t.lastValues[i]) / elapsed
+			// the counter is reset or wraps, the rate starts over from the next sample
+			if v < 0 {
+				continue
+			}
+		}
+		v *= m.scale
+		t.current[i] = v
+		t.windows[i].add(now, v, t.length)
+	}
+
+	t.lastTime = now
+	t.lastValues = append(t.lastValues[:0], values...)
+}
+
+// promName builds the metric name from the key and unit, e.g. colibri_cpu_millicores
+func promName(m metric) string {
+	unit := strings.ReplaceAll(m.unitName, "/s", "_per_second")
+	return "colibri_" + m.key + "_" + unit
+}
+
+// write renders all targets in Prometheus text format, grouped by metric name
+func (e *promExporter) write(w io.Writer) {
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	quantile := strconv.FormatFloat(e.pert/100, 'f', -1, 64)
+	window := e.window.String()
+
+	type line struct{ name, text string }
+	var lines []line
+	helps := make(map[string]string)
+
+	for _, t := range e.targets {
+		lines = append(lines, line{"colibri_samples_total", fmt.Sprintf("colibri_samples_total{%s} %d", t.labels, t.samples)})
+		helps["colibri_samples_total"] = "counter|Samples taken from the target."
+
+		for i, m := range t.metrics {
+			name := promName(m)
+			helps[name] = fmt.Sprintf("gauge|The current %s of the target in %s.", m.label, m.unitName)
+			lines = append(lines, line{name, fmt.Sprintf("%s{%s} %g", name, t.labels, t.current[i])})
+
+			values := t.windows[i].values
+			if len(values) == 0 {
+				continue
+			}
+			max, _ := stats.Max(values)
+			pert, _ := stats.Percentile(values, e.pert)
+
+			helps[name+"_window_max"] = fmt.Sprintf("gauge|The max %s over the last %s.", m.label, window)
+			lines = append(lines, line{name + "_window_max", fmt.Sprintf("%s_window_max{%s} %g", name, t.labels, max)})
+			helps[name+"_window_quantile"] = fmt.Sprintf("gauge|The percentile of %s over the last %s.", m.label, window)
+			lines = append(lines, line{name + "_window_quantile",
+				fmt.Sprintf("%s_window_quantile{%s,quantile=\"%s\"} %g", name, t.labels, quantile, pert)})
+		}
+	}
+
+	// the text format requires the lines of a metric to be together
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].name < lines[j].name })
+
+	last := ""
+	for _, l := range lines {
+		if l.name != last {
+			help := strings.SplitN(helps[l.name], "|", 2)
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", l.name, help[1], l.name, help[0])
+			last = l.name
+		}
+		fmt.Fprintln(w, l.text)
+	}
+}
+
+func (e *promExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", promContentType)
+	e.write(w)
+}
+
+// serve exposes the metrics at /metrics, in the background
+func (e *promExporter) serve(listen string) error {
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok\n")
+	})
+
+	srv := &http.Server{Addr: listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return newError(errUsage, "cannot listen on %s: %v", listen, err)
+	}
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Print("Prometheus endpoint stopped: ", err)
+		}
+	}()
+	log.Printf("Exposing Prometheus metrics at http://%s/metrics", listen)
+	return nil
+}
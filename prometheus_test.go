@@ -0,0 +1,148 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPromLabels(t *testing.T) {
+
+	t.Setenv("NODE_NAME", "gabbro")
+	tests := []struct {
+		name   string
+		target Target
+		want   string
+	}{
+		{"birdy", Target{Pid: 42}, `name="birdy",pid="42",node="gabbro"`},
+		{"birdy", Target{Pid: 42, Namespace: "prod", Pod: "web"}, `name="birdy",pid="42",node="gabbro",namespace="prod",pod="web"`},
+		{`say "hi"`, Target{Pid: 1}, `name="say \"hi\"",pid="1",node="gabbro"`},
+		{`C:\tmp`, Target{Pid: 1}, `name="C:\\tmp",pid="1",node="gabbro"`},
+		{"two\nlines", Target{Pid: 1}, `name="two\nlines",pid="1",node="gabbro"`},
+		{"app", Target{Pid: 1, PodUid: "u1", ContainerId: "c1", QosClass: "Burstable"},
+			`name="app",pid="1",node="gabbro",pod_uid="u1",container_id="c1",qos_class="Burstable"`},
+	}
+	for _, tt := range tests {
+		if got := promLabels(tt.name, tt.target); got != tt.want {
+			t.Errorf("promLabels(%q) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRollingWindow(t *testing.T) {
+
+	start := time.Unix(1650000000, 0)
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+
+	tests := []struct {
+		name   string
+		adds   []int
+		length time.Duration
+		want   []float64
+	}{
+		{"within", []int{0, 100, 200}, time.Second, []float64{0, 100, 200}},
+		// the sample exactly a window old is kept
+		{"boundary", []int{0, 500, 1000}, time.Second, []float64{0, 500, 1000}},
+		{"expired", []int{0, 500, 1000, 1001, 2500}, time.Second, []float64{2500}},
+		{"gap", []int{0, 10, 20, 5000}, time.Second, []float64{5000}},
+	}
+	for _, tt := range tests {
+		var w rollingWindow
+		for _, ms := range tt.adds {
+			w.add(at(ms), float64(ms), tt.length)
+		}
+		if !reflect.DeepEqual(w.values, tt.want) || len(w.times) != len(w.values) {
+			t.Errorf("%s: window %v, want %v", tt.name, w.values, tt.want)
+		}
+	}
+
+	// a long run keeps the buffer bound to the window
+	var w rollingWindow
+	for ms := 0; ms < 100000; ms += 5 {
+		w.add(at(ms), float64(ms), time.Second)
+	}
+	if len(w.values) != 201 || cap(w.values) > 2*len(w.values)+64 {
+		t.Errorf("window of %d numbers in a buffer of %d, want 201 in a compacted one", len(w.values), cap(w.values))
+	}
+	if w.values[0] != 99995-1000 {
+		t.Errorf("window starts at %v, want %v", w.values[0], 99995-1000)
+	}
+}
+
+func TestPromEndpoint(t *testing.T) {
+
+	e := newPromExporter(time.Second, 50)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	sk := e.attach(`name="birdy"`, []metric{egressMetric, memMetric})
+	start := time.Unix(1650000000, 0)
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	// 1, 3 and 2 bytes per millisecond, then a reset skipped, the current rate stays at the last one
+	sk.observe(at(0), []float64{0, 100})
+	sk.observe(at(10), []float64{10, 300})
+	sk.observe(at(20), []float64{40, 200})
+	sk.observe(at(30), []float64{60, 400})
+	sk.observe(at(40), []float64{5, 500})
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != promContentType {
+		t.Errorf("content type %q, want %q", ct, promContentType)
+	}
+	body, _ := io.ReadAll(resp.Body)
+
+	for _, line := range []string{
+		"# TYPE colibri_samples_total counter",
+		`colibri_samples_total{name="birdy"} 5`,
+		"# TYPE colibri_egress_bytes_per_second gauge",
+		`colibri_egress_bytes_per_second{name="birdy"} 2000`,
+		`colibri_egress_bytes_per_second_window_max{name="birdy"} 3000`,
+		`colibri_egress_bytes_per_second_window_quantile{name="birdy",quantile="0.5"} 1500`,
+		`colibri_ram_bytes{name="birdy"} 500`,
+		`colibri_ram_bytes_window_max{name="birdy"} 500`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("no line %s in\n%s", line, body)
+		}
+	}
+
+	// the lines of a metric are together, under a single header
+	headers := map[string]int{}
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			headers[strings.Fields(line)[2]]++
+		}
+	}
+	for name, n := range headers {
+		if n != 1 {
+			t.Errorf("%d headers of %s, want 1", n, name)
+		}
+	}
+
+	e.detach(sk)
+	if e.write(io.Discard); len(e.targets) != 0 {
+		t.Errorf("%d targets after detach, want none", len(e.targets))
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The protocol collector, enabled by --proto, reads the TCP and UDP counters of the network namespace of the
+// target from /proc/<pid>/net/snmp and /proc/<pid>/net/netstat, which tell network trouble that bandwidth does not:
+// retransmits, connections opened, resets, listen queue drops and UDP receive errors.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// protoCounter is a metric of a counter in snmp or netstat, named by its protocol and field, e.g. Tcp.RetransSegs
+type protoCounter struct {
+	file, name string
+	m          metric
+}
+
+var protoCounters = []protoCounter{
+	{"snmp", "Tcp.OutSegs", protoMetric("TCP sent segments", "tcp_out_segs", "packets/s")},
+	{"snmp", "Tcp.RetransSegs", protoMetric("TCP retransmits", "tcp_retrans", "packets/s")},
+	{"snmp", "Tcp.ActiveOpens", protoMetric("TCP active opens", "tcp_active_opens", "connections/s")},
+	{"snmp", "Tcp.PassiveOpens", protoMetric("TCP passive opens", "tcp_passive_opens", "connections/s")},
+	{"snmp", "Tcp.OutRsts", protoMetric("TCP resets sent", "tcp_out_resets", "packets/s")},
+	{"snmp", "Tcp.EstabResets", protoMetric("TCP established resets", "tcp_estab_resets", "connections/s")},
+	{"netstat", "TcpExt.ListenDrops", protoMetric("TCP listen drops", "tcp_listen_drops", "connections/s")},
+	{"netstat", "TcpExt.ListenOverflows", protoMetric("TCP listen overflows", "tcp_listen_overflows", "connections/s")},
+	{"snmp", "Udp.InErrors", protoMetric("UDP receive errors", "udp_in_errors", "packets/s")},
+	{"snmp", "Udp.RcvbufErrors", protoMetric("UDP receive buffer errors", "udp_rcvbuf_errors", "packets/s")},
+}
+
+func protoMetric(label string, key string, unit string) metric {
+	return metric{label, key, key, true, transRate(1000), unit, 1000, nil, nil}
+}
+
+// newProtoCollector reads the counters of the network namespace of the process, those missing in the kernel are left out
+func newProtoCollector(pid string) (collector, error) {
+
+	files := []string{"snmp", "netstat"}
+	stats, err := readProtoFiles(pid, files)
+	if err != nil {
+		return collector{}, fileError(errTarget, err)
+	}
+
+	var counters []protoCounter
+	var missing []string
+	for _, c := range protoCounters {
+		if _, ok := stats[c.name]; ok {
+			counters = append(counters, c)
+		} else {
+			missing = append(missing, c.name)
+		}
+	}
+	if missing != nil {
+		log.Printf("No %s of process %s, they are not sampled", strings.Join(missing, ", "), pid)
+	}
+
+	var metrics []metric
+	for _, c := range counters {
+		metrics = append(metrics, c.m)
+	}
+	return collector{
+		metrics: metrics,
+		read: func() ([]float64, error) {
+			stats, err := readProtoFiles(pid, files)
+			if err != nil {
+				return nil, err
+			}
+			values := make([]float64, len(counters))
+			for i, c := range counters {
+				values[i] = stats[c.name]
+			}
+			return values, nil
+		},
+	}, nil
+}
+
+func readProtoFiles(pid string, files []string) (map[string]float64, error) {
+	stats := make(map[string]float64)
+	for _, file := range files {
+		if err := readProtoStats(procPath(pid, "net/"+file), stats); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// readProtoStats reads a file of snmp format into stats: every protocol has a line of field names,
+// followed by a line of their numbers, both led by the protocol, e.g. "Tcp:"
+func readProtoStats(path string, stats map[string]float64) error {
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines)%2 != 0 {
+		return fmt.Errorf("malformed %s", path)
+	}
+	for i := 0; i < len(lines); i += 2 {
+		names, numbers := strings.Fields(lines[i]), strings.Fields(lines[i+1])
+		if len(names) == 0 || len(names) != len(numbers) || names[0] != numbers[0] {
+			return fmt.Errorf("malformed %s", path)
+		}
+		proto := strings.TrimSuffix(names[0], ":")
+		for j := 1; j < len(names); j++ {
+			stats[proto+"."+names[j]] = stringToFloat(numbers[j])
+		}
+	}
+	return nil
+}
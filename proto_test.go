@@ -0,0 +1,72 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadProtoStats(t *testing.T) {
+
+	snmp := `Ip: Forwarding DefaultTTL
+Ip: 1 64
+Tcp: RtoAlgorithm ActiveOpens PassiveOpens OutSegs RetransSegs MaxConn
+Tcp: 1 120 35 98765 43 -1
+Udp: InDatagrams InErrors RcvbufErrors
+Udp: 500 2 1
+`
+	netstat := `TcpExt: SyncookiesSent ListenOverflows ListenDrops
+TcpExt: 0 7 9
+IpExt: InOctets OutOctets
+IpExt: 123456789012 98765432109
+`
+	stats := make(map[string]float64)
+	for _, content := range []string{snmp, netstat} {
+		if err := readProtoStats(writeTemp(t, "snmp", content), stats); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]float64{
+		"Ip.Forwarding": 1, "Ip.DefaultTTL": 64,
+		"Tcp.RtoAlgorithm": 1, "Tcp.ActiveOpens": 120, "Tcp.PassiveOpens": 35,
+		"Tcp.OutSegs": 98765, "Tcp.RetransSegs": 43, "Tcp.MaxConn": -1,
+		"Udp.InDatagrams": 500, "Udp.InErrors": 2, "Udp.RcvbufErrors": 1,
+		"TcpExt.SyncookiesSent": 0, "TcpExt.ListenOverflows": 7, "TcpExt.ListenDrops": 9,
+		"IpExt.InOctets": 123456789012, "IpExt.OutOctets": 98765432109,
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("readProtoStats() = %v, want %v", stats, want)
+	}
+
+	malformed := []string{
+		// a number is missing
+		"Tcp: ActiveOpens PassiveOpens\nTcp: 120\n",
+		// the numbers of another protocol
+		"Tcp: ActiveOpens\nUdp: 120\n",
+		// a line of names without its numbers
+		"Tcp: ActiveOpens\nTcp: 120\nUdp: InErrors\n",
+	}
+	for _, content := range malformed {
+		if err := readProtoStats(writeTemp(t, "snmp", content), make(map[string]float64)); err == nil {
+			t.Errorf("readProtoStats(%q) has no error", content)
+		}
+	}
+
+	if err := readProtoStats(filepath.Join(t.TempDir(), "missing"), make(map[string]float64)); err == nil {
+		t.Error("readProtoStats(missing) has no error")
+	}
+}
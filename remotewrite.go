@@ -0,0 +1,140 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The Prometheus remote-write writer, enabled by --remote-write, ships every sample as a snappy-compressed
+// protobuf WriteRequest of remote-write 1.0. The protobuf encoding is written out here to keep Colibri free of
+// the Prometheus modules, only the parts needed for a WriteRequest.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+type remoteWriter struct {
+	url     string
+	client  *http.Client
+	metrics []metric
+	// the encoded labels of every metric, __name__ included
+	labels [][]byte
+}
+
+func newRemoteWriter(url string, timeout time.Duration, labels [][2]string, metrics []metric) *remoteWriter {
+
+	w := &remoteWriter{url: url, client: &http.Client{Timeout: timeout}, metrics: metrics}
+
+	for _, m := range metrics {
+		name, _ := sampleSeries(m)
+		name = "colibri_" + name
+		if m.counter {
+			name += "_total"
+		}
+
+		// remote-write requires labels sorted by name
+		series := append([][2]string{{"__name__", name}}, labels...)
+		sort.Slice(series, func(i, j int) bool { return series[i][0] < series[j][0] })
+
+		var encoded []byte
+		for _, l := range series {
+			var label []byte
+			label = appendString(label, 1, l[0])
+			label = appendString(label, 2, l[1])
+			encoded = appendBytes(encoded, 1, label)
+		}
+		w.labels = append(w.labels, encoded)
+	}
+	return w
+}
+
+func (w *remoteWriter) write(batch []sample) error {
+
+	// one time series per metric, with the samples in order
+	var request []byte
+	for i, m := range w.metrics {
+		_, scale := sampleSeries(m)
+		series := append([]byte(nil), w.labels[i]...)
+		for _, s := range batch {
+			var point []byte
+			point = appendDouble(point, 1, s.values[i]*scale)
+			point = appendVarint(point, 2, uint64(s.t.UnixMilli()))
+			series = appendBytes(series, 2, point)
+		}
+		request = appendBytes(request, 1, series)
+	}
+
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(snappy.Encode(nil, request)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("remote write responds %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+func (w *remoteWriter) close() error {
+	return nil
+}
+
+// Protobuf wire format, of the field types in a WriteRequest
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendTag(b []byte, field int, wireType int) []byte {
+	return appendUvarint(b, uint64(field<<3|wireType))
+}
+
+func appendVarint(b []byte, field int, v uint64) []byte {
+	return appendUvarint(appendTag(b, field, 0), v)
+}
+
+func appendDouble(b []byte, field int, v float64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+	return append(appendTag(b, field, 1), buf[:]...)
+}
+
+func appendBytes(b []byte, field int, v []byte) []byte {
+	b = appendUvarint(appendTag(b, field, 2), uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendString(b []byte, field int, v string) []byte {
+	b = appendUvarint(appendTag(b, field, 2), uint64(len(v)))
+	return append(b, v...)
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+func TestRemoteWrite(t *testing.T) {
+
+	var body []byte
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	w := newRemoteWriter(srv.URL, time.Second, [][2]string{{"job", "colibri"}}, []metric{memMetric})
+	if err := w.write([]sample{{time.UnixMilli(1000), []float64{5}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]string{
+		"Content-Type":                      "application/x-protobuf",
+		"Content-Encoding":                  "snappy",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	} {
+		if got := header.Get(key); got != want {
+			t.Errorf("header %s = %q, want %q", key, got, want)
+		}
+	}
+
+	request, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatalf("reference decoder fails: %v", err)
+	}
+	// WriteRequest{timeseries: [TimeSeries{labels: [__name__, job], samples: [Sample{value: 5, timestamp: 1000}]}]}
+	golden := strings.Join([]string{
+		"0a3d",                                                  // timeseries, 61 bytes
+		"0a1d", "0a08" + hex.EncodeToString([]byte("__name__")), // label, name
+		"1211" + hex.EncodeToString([]byte("colibri_ram_bytes")), // value
+		"0a0e", "0a03" + hex.EncodeToString([]byte("job")),
+		"1207" + hex.EncodeToString([]byte("colibri")),
+		"120c",               // sample, 12 bytes
+		"090000000000001440", // value, double 5
+		"10e807",             // timestamp, varint 1000
+	}, "")
+	if got := hex.EncodeToString(request); got != golden {
+		t.Errorf("request = %s, want %s", got, golden)
+	}
+}
+
+func TestRemoteWriteFailure(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	w := newRemoteWriter(srv.URL, time.Second, nil, []metric{memMetric})
+	err := w.write([]sample{{time.UnixMilli(1000), []float64{5}}})
+	if err == nil || !strings.Contains(err.Error(), "out of order sample") {
+		t.Errorf("write() = %v, want the message of the server", err)
+	}
+}
@@ -16,71 +16,319 @@ package main
 
 import (
     "bytes"
-    "io/ioutil"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/json"
+    "errors"
+    "io"
     "log"
     "net/http"
-    "crypto/x509"
-    "crypto/tls"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
 )
 
 const (
     Url = "https://10.96.0.1/api/v1/namespaces/colibri/services/colibri-apiserver:http/proxy/colibri/"
     TokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
     CaFile = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+
+    // the delay before the first retry, doubled for each following one
+    retryBackoff = 500 * time.Millisecond
+    maxRetryBackoff = 30 * time.Second
 )
 
-func createHttpClient() *http.Client {
+// apiConfig is the configuration of Colibri API client
+type apiConfig struct {
+    // The base URL, results are posted to url + ID
+    url string
+    // The CA certificate for verifying the server, empty for the system pool
+    caFile string
+    // The bearer token, empty for no authorization
+    tokenFile string
+    // The timeout of each request
+    timeout time.Duration
+    // The retries after the first failed request
+    retries int
+    // The directory keeping the results failed to send, empty to disable
+    spool string
+}
+
+type apiClient struct {
+    config apiConfig
+    client *http.Client
 
-    caCert, err := ioutil.ReadFile(CaFile)
-    if err != nil {
-        log.Fatal(err)
+    // service account tokens are rotated, so reload the token when the file changes
+    token string
+    tokenModTime time.Time
+}
+
+// spooled is a result waiting in the spool directory to be resent
+type spooled struct {
+    Id string `json:"id"`
+    Payload json.RawMessage `json:"payload"`
+}
+
+func newApiClient(config apiConfig) (*apiClient, error) {
+
+    tlsConfig := &tls.Config{}
+
+    if config.caFile != "" {
+        caCert, err := os.ReadFile(config.caFile)
+        if err != nil {
+            return nil, fileError(errApi, err)
+        }
+        caCertPool := x509.NewCertPool()
+        if !caCertPool.AppendCertsFromPEM(caCert) {
+            return nil, newError(errApi, "no certificate found in %s", config.caFile)
+        }
+        tlsConfig.RootCAs = caCertPool
     }
-    caCertPool := x509.NewCertPool()
-    caCertPool.AppendCertsFromPEM(caCert)
 
     client := &http.Client{
+        Timeout: config.timeout,
         Transport: &http.Transport{
-            TLSClientConfig: &tls.Config{
-                RootCAs:      caCertPool,
-            },
+            Proxy: http.ProxyFromEnvironment,
+            TLSClientConfig: tlsConfig,
         },
     }
-    return client
+    if !strings.HasSuffix(config.url, "/") {
+        config.url += "/"
+    }
+    return &apiClient{config: config, client: client}, nil
 }
 
-func sendMetric(value []byte, rid string) {
+func (c *apiClient) bearer() (string, error) {
 
-    //create bearer with token
-    token, err := ioutil.ReadFile(TokenFile)
+    if c.config.tokenFile == "" {
+        return "", nil
+    }
+
+    info, err := os.Stat(c.config.tokenFile)
     if err != nil {
-        log.Fatal(err)
+        return "", fileError(errApi, err)
     }
 
-    var bearer = "Bearer " + string(token)
+    if c.token == "" || !info.ModTime().Equal(c.tokenModTime) {
+        token, err := os.ReadFile(c.config.tokenFile)
+        if err != nil {
+            return "", fileError(errApi, err)
+        }
+        c.token = strings.TrimSpace(string(token))
+        c.tokenModTime = info.ModTime()
+    }
+    return "Bearer " + c.token, nil
+}
+
+// post sends the payload once. The returned bool tells if the failure is worth a retry,
+// any failure but a rejection of the payload itself, which is final.
+func (c *apiClient) post(rid string, value []byte) (bool, error) {
+
+    bearer, err := c.bearer()
+    if err != nil {
+        // the token may be in the middle of a rotation
+        return true, err
+    }
 
     //build request
-    req, err := http.NewRequest("POST", Url+rid, bytes.NewBuffer(value))
+    req, err := http.NewRequest("POST", c.config.url+rid, bytes.NewReader(value))
     if err != nil {
-        log.Fatal(err)
+        return false, &Error{errApi, err}
     }
 
     // add headers
-    req.Header.Add("Authorization", bearer)
+    if bearer != "" {
+        req.Header.Add("Authorization", bearer)
+    }
     req.Header.Add("Content-Type", "application/json")
 
-    // create http client
-    client := createHttpClient()
-
-    resp, err := client.Do(req)
-
+    resp, err := c.client.Do(req)
     if err != nil {
-        log.Fatal(err)
+        return true, &Error{errApi, err}
     }
     defer resp.Body.Close()
 
-    body, err := ioutil.ReadAll(resp.Body)
+    body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
     if err != nil {
         log.Println("Error while reading the response bytes:", err)
     }
-    log.Println(string([]byte(body)))
+    log.Println(string(body))
+
+    if resp.StatusCode/100 == 2 {
+        return false, nil
+    }
+
+    err = newError(errApi, "colibri API responds %s", resp.Status)
+
+    return !rejected(resp.StatusCode), err
+}
+
+// rejected tells the server rejects the result itself, e.g. an invalid ID, sending it again does not help.
+// Other failures, like 401 and 403 of an expired token, may pass later, so the result is kept.
+func rejected(status int) bool {
+    return status == http.StatusBadRequest || status == http.StatusConflict || status == http.StatusUnprocessableEntity
+}
+
+// send posts the payload with exponential backoff retries.
+// If the API is still unreachable, the payload is kept in the spool directory for resending later.
+func (c *apiClient) send(value []byte, rid string) error {
+
+    err := c.sendWithRetries(value, rid)
+
+    var retryable *retryableError
+    if err == nil || c.config.spool == "" || !errors.As(err, &retryable) {
+        return err
+    }
+
+    if spoolErr := c.keep(value, rid); spoolErr != nil {
+        log.Print("Cannot keep the result in spool: ", spoolErr)
+        return err
+    }
+    log.Printf("Colibri API is unreachable (%v), the result is kept in %s for resending later", err, c.config.spool)
+    return nil
+}
+
+// retryableError marks a failure remaining after all retries, which could succeed later
+type retryableError struct {
+    err error
+}
+
+func (e *retryableError) Error() string {
+    return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+    return e.err
+}
+
+func (c *apiClient) sendWithRetries(value []byte, rid string) error {
+
+    backoff := retryBackoff
+
+    for attempt := 0; ; attempt++ {
+        retryable, err := c.post(rid, value)
+        if err == nil {
+            return nil
+        }
+        if !retryable {
+            return err
+        }
+        if attempt >= c.config.retries {
+            return &retryableError{err}
+        }
+
+        log.Printf("Calling API failed (%v), retrying in %s", err, backoff)
+        time.Sleep(backoff)
+        backoff *= 2
+        if backoff > maxRetryBackoff {
+            backoff = maxRetryBackoff
+        }
+    }
+}
+
+func (c *apiClient) keep(value []byte, rid string) error {
+
+    if err := os.MkdirAll(c.config.spool, 0755); err != nil {
+        return err
+    }
+
+    content, err := json.Marshal(spooled{rid, json.RawMessage(value)})
+    if err != nil {
+        return err
+    }
+
+    // write to a temporary file first, so a crash never leaves a partial result to resend
+    name := filepath.Join(c.config.spool, strconv.FormatInt(time.Now().UnixNano(), 10) + ".json")
+    if err = os.WriteFile(name + ".tmp", content, 0644); err != nil {
+        return err
+    }
+    return os.Rename(name + ".tmp", name)
+}
+
+// resendSpool sends the results kept in the spool directory, in the order they are kept.
+// It stops at the first result failing again, and keeps it with the later ones.
+func (c *apiClient) resendSpool() {
+
+    if c.config.spool == "" {
+        return
+    }
+
+    files, err := filepath.Glob(filepath.Join(c.config.spool, "*.json"))
+    if err != nil || len(files) == 0 {
+        return
+    }
+    log.Printf("Resending %d results kept in %s", len(files), c.config.spool)
+
+    for _, f := range files {
+        content, err := os.ReadFile(f)
+        if err != nil {
+            log.Print("Cannot read kept result: ", err)
+            continue
+        }
+
+        var s spooled
+        if err = json.Unmarshal(content, &s); err != nil {
+            log.Printf("Dropping malformed result %s: %v", f, err)
+            os.Remove(f)
+            continue
+        }
+
+        retryable, err := c.post(s.Id, s.Payload)
+        if err != nil && retryable {
+            log.Print("Colibri API still fails, keeping the results: ", err)
+            return
+        }
+        if err != nil {
+            log.Printf("Dropping result %s rejected by Colibri API: %v", f, err)
+        }
+        os.Remove(f)
+    }
+}
+
+func (c apiConfig) validate() error {
+    if !strings.HasPrefix(c.url, "http://") && !strings.HasPrefix(c.url, "https://") {
+        return newError(errUsage, "--api-url must be an http or https URL, got %q", c.url)
+    }
+    if c.timeout <= 0 {
+        return newError(errUsage, "--api-timeout must be positive, got %s", c.timeout)
+    }
+    if c.retries < 0 {
+        return newError(errUsage, "--api-retries cannot be negative, got %d", c.retries)
+    }
+    return nil
+}
+
+// get fetches a JSON document from the path under the base URL into v.
+// It returns the status code, and an error for failures other than the status.
+func (c *apiClient) get(path string, v interface{}) (int, error) {
+
+    bearer, err := c.bearer()
+    if err != nil {
+        return 0, err
+    }
+
+    req, err := http.NewRequest("GET", c.config.url + strings.TrimPrefix(path, "/"), nil)
+    if err != nil {
+        return 0, &Error{errApi, err}
+    }
+    if bearer != "" {
+        req.Header.Add("Authorization", bearer)
+    }
+    req.Header.Add("Accept", "application/json")
+
+    resp, err := c.client.Do(req)
+    if err != nil {
+        return 0, &Error{errApi, err}
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode/100 != 2 {
+        return resp.StatusCode, nil
+    }
+    if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+        return resp.StatusCode, &Error{errApi, err}
+    }
+    return resp.StatusCode, nil
 }
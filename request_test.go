@@ -0,0 +1,207 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// apiStub answers the posted results with the statuses in turn, the last one repeated
+type apiStub struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	paths    []string
+	bodies   []string
+	auths    []string
+}
+
+func newApiStub(t *testing.T, statuses ...int) *apiStub {
+	s := &apiStub{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("content type %q, want application/json", ct)
+		}
+		s.paths = append(s.paths, r.URL.Path)
+		s.bodies = append(s.bodies, string(body))
+		s.auths = append(s.auths, r.Header.Get("Authorization"))
+		status := s.statuses[0]
+		if len(s.statuses) > 1 {
+			s.statuses = s.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *apiStub) calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.paths)
+}
+
+func newTestApiClient(t *testing.T, url string, retries int, spool string) *apiClient {
+	c, err := newApiClient(apiConfig{url: url + "/colibri", timeout: time.Second, retries: retries, spool: spool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestApiSend(t *testing.T) {
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stub := newApiStub(t, http.StatusCreated)
+	c := newTestApiClient(t, stub.URL, 0, "")
+	c.config.tokenFile = tokenFile
+
+	if err := c.send([]byte(`{"a":1}`), "default.web.42"); err != nil {
+		t.Fatal(err)
+	}
+	// the rotated token is read again
+	if err := os.WriteFile(tokenFile, []byte("second\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(tokenFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.send([]byte(`{"a":2}`), "default.web.42"); err != nil {
+		t.Fatal(err)
+	}
+
+	if stub.paths[0] != "/colibri/default.web.42" || stub.bodies[0] != `{"a":1}` {
+		t.Errorf("posted %s %s, want the result to /colibri/default.web.42", stub.paths[0], stub.bodies[0])
+	}
+	if stub.auths[0] != "Bearer first" || stub.auths[1] != "Bearer second" {
+		t.Errorf("authorizations %q, want the token before and after rotation", stub.auths)
+	}
+}
+
+func TestApiRetries(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		statuses []int
+		retries  int
+		calls    int
+		ok       bool
+	}{
+		{"retried", []int{http.StatusServiceUnavailable, http.StatusCreated}, 1, 2, true},
+		{"too many requests", []int{http.StatusTooManyRequests, http.StatusCreated}, 1, 2, true},
+		{"rejected", []int{http.StatusBadRequest}, 3, 1, false},
+		{"unprocessable", []int{http.StatusUnprocessableEntity}, 3, 1, false},
+		{"expired token", []int{http.StatusUnauthorized, http.StatusCreated}, 1, 2, true},
+		{"forbidden", []int{http.StatusForbidden}, 1, 2, false},
+		{"out of retries", []int{http.StatusBadGateway}, 1, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newApiStub(t, tt.statuses...)
+			err := newTestApiClient(t, stub.URL, tt.retries, "").send([]byte(`{}`), "default.web.42")
+			if (err == nil) != tt.ok {
+				t.Errorf("send() = %v, want ok %v", err, tt.ok)
+			}
+			if err != nil && exitCode(err) != int(errApi) {
+				t.Errorf("exit code = %d, want %d", exitCode(err), errApi)
+			}
+			if stub.calls() != tt.calls {
+				t.Errorf("called %d times, want %d", stub.calls(), tt.calls)
+			}
+		})
+	}
+}
+
+func TestApiSpool(t *testing.T) {
+
+	spool := t.TempDir()
+	down := newApiStub(t, http.StatusServiceUnavailable)
+	c := newTestApiClient(t, down.URL, 0, spool)
+	for _, result := range []string{`{"n":1}`, `{"n":2}`} {
+		if err := c.send([]byte(result), "default.web.42"); err != nil {
+			t.Fatalf("send() = %v, want the result kept", err)
+		}
+	}
+	// a rejected result is not kept
+	rejecting := newApiStub(t, http.StatusBadRequest)
+	if err := newTestApiClient(t, rejecting.URL, 0, spool).send([]byte(`{"n":3}`), "default.web.42"); err == nil {
+		t.Error("send() of a rejected result succeeds")
+	}
+	if kept, _ := filepath.Glob(filepath.Join(spool, "*.json")); len(kept) != 2 {
+		t.Fatalf("kept %d results, want 2", len(kept))
+	}
+
+	// still down, the results stay
+	c.resendSpool()
+	if kept, _ := filepath.Glob(filepath.Join(spool, "*.json")); len(kept) != 2 {
+		t.Fatalf("kept %d results after failing again, want 2", len(kept))
+	}
+
+	up := newApiStub(t, http.StatusCreated)
+	newTestApiClient(t, up.URL, 0, spool).resendSpool()
+	if len(up.bodies) != 2 || up.bodies[0] != `{"n":1}` || up.bodies[1] != `{"n":2}` || up.paths[0] != "/colibri/default.web.42" {
+		t.Errorf("resent %v to %v, want both results in order", up.bodies, up.paths)
+	}
+	if kept, _ := filepath.Glob(filepath.Join(spool, "*")); len(kept) != 0 {
+		t.Errorf("%d files left in spool, want none", len(kept))
+	}
+}
+
+func TestApiSpoolKeptOnAuthFailure(t *testing.T) {
+
+	spool := t.TempDir()
+	down := newApiStub(t, http.StatusServiceUnavailable)
+	if err := newTestApiClient(t, down.URL, 0, spool).send([]byte(`{"n":1}`), "default.web.42"); err != nil {
+		t.Fatalf("send() = %v, want the result kept", err)
+	}
+
+	// the token expired, the server does not reject the result itself
+	unauthorized := newApiStub(t, http.StatusUnauthorized)
+	newTestApiClient(t, unauthorized.URL, 0, spool).resendSpool()
+	if unauthorized.calls() != 1 {
+		t.Errorf("called %d times, want 1", unauthorized.calls())
+	}
+	if kept, _ := filepath.Glob(filepath.Join(spool, "*.json")); len(kept) != 1 {
+		t.Fatalf("kept %d results after 401, want 1", len(kept))
+	}
+
+	// the token file is missing in the middle of a rotation
+	c := newTestApiClient(t, unauthorized.URL, 0, spool)
+	c.config.tokenFile = filepath.Join(t.TempDir(), "token")
+	c.resendSpool()
+	if kept, _ := filepath.Glob(filepath.Join(spool, "*.json")); len(kept) != 1 {
+		t.Fatalf("kept %d results without a token, want 1", len(kept))
+	}
+
+	rejecting := newApiStub(t, http.StatusConflict)
+	newTestApiClient(t, rejecting.URL, 0, spool).resendSpool()
+	if kept, _ := filepath.Glob(filepath.Join(spool, "*.json")); len(kept) != 0 {
+		t.Errorf("kept %d results rejected with 409, want none", len(kept))
+	}
+}
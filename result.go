@@ -0,0 +1,318 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The result document of a run, sent to Colibri API, printed by --json and stored next to raw outputs.
+// Its JSON Schema is published at schema/result.schema.json, keep them in sync.
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/montanaflynn/stats"
+)
+
+// ResultSchemaVersion is bumped on any incompatible change of Result
+const ResultSchemaVersion = "colibri.result/v1"
+
+// the percentiles always reported, besides the one given by --pert
+var defaultPercentiles = []float64{50, 90, 95, 99}
+
+type Result struct {
+	SchemaVersion string `json:"schemaVersion"`
+	// The name of this work given by --name
+	Name          string    `json:"name"`
+	Target        Target    `json:"target"`
+	Node          string    `json:"node"`
+	CgroupVersion int       `json:"cgroupVersion"`
+	SpanMs        int       `json:"spanMs"`
+	Samples       int       `json:"samples"`
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	// The run is stopped by signal, the numbers cover a part of the planned collection
+	Interrupted bool                     `json:"interrupted"`
+	Metrics     map[string]MetricSummary `json:"metrics"`
+	// The breakdown by container in Pod mode, Metrics holds the Pod aggregate
+	Containers []ContainerResult `json:"containers,omitempty"`
+	// The restarts and counter resets of the target in follow mode
+	Events []FollowEvent `json:"events,omitempty"`
+	// The numbers of every target when profiling several of them, Metrics holds their sums on the same ticks
+	Targets []TargetResult `json:"targets,omitempty"`
+	// The stalls of the target related with the activity of neighbors in context mode
+	Correlations []Correlation `json:"correlations,omitempty"`
+	// The busiest processes and threads under the target with --top
+	Processes []TaskCpu `json:"processes,omitempty"`
+	Threads   []TaskCpu `json:"threads,omitempty"`
+	// The growth of the numbers of inventory with --inventory
+	Trends []Trend `json:"trends,omitempty"`
+	// The trend of the working set, with RAM sampled
+	MemoryTrend *MemoryTrend `json:"memoryTrend,omitempty"`
+}
+
+// MemoryTrend is the line fitted to the working set over the run by the Theil-Sen estimator
+type MemoryTrend struct {
+	SlopeMiBPerMinute float64 `json:"slopeMiBPerMinute"`
+	// The share of the pairs of samples growing or shrinking along the slope
+	Confidence float64 `json:"confidence"`
+	// leak, growing like a leak over a capture shorter than a minute, stable, or insufficient with too few samples
+	// or a capture shorter than 10 seconds
+	Verdict string `json:"verdict"`
+	// The memory limit of the cgroup, omitted if unlimited
+	LimitBytes float64 `json:"limitBytes,omitempty"`
+	// The time until the working set reaches the limit at the slope, omitted unless leak or growing with a limit
+	TimeToLimitSeconds *float64 `json:"timeToLimitSeconds,omitempty"`
+}
+
+// Trend is the line fitted to the numbers of a metric over the run, by least squares
+type Trend struct {
+	Metric string `json:"metric"`
+	Unit   string `json:"unit"`
+	// The first and last numbers
+	First float64 `json:"first"`
+	Last  float64 `json:"last"`
+	// The slope of the line, in the unit per minute
+	PerMinute float64 `json:"perMinute"`
+}
+
+// TaskCpu is the CPU used by a process or a thread under the target
+type TaskCpu struct {
+	Pid int `json:"pid"`
+	// The thread ID, omitted for a process
+	Tid     int    `json:"tid,omitempty"`
+	Command string `json:"command"`
+	// The CPU time, user and system, and its mean rate
+	CpuSeconds float64 `json:"cpuSeconds"`
+	Millicores float64 `json:"millicores"`
+}
+
+// Correlation relates a stall of the target with the activity of a neighbor, per interval between samples
+type Correlation struct {
+	// The keys of the metrics
+	Stall    string `json:"stall"`
+	Neighbor string `json:"neighbor"`
+	// The Pearson correlation coefficient, 0 if either series is constant
+	Pearson float64 `json:"pearson"`
+	// The intervals of stall spikes, and those of them during neighbor spikes
+	StallSpikes int `json:"stallSpikes"`
+	Coincident  int `json:"coincident"`
+}
+
+// TargetResult holds the numbers of one of several targets
+type TargetResult struct {
+	Target  Target                   `json:"target"`
+	Metrics map[string]MetricSummary `json:"metrics"`
+}
+
+// FollowEvent marks a restart of the target, or a reset of its counters, in follow mode
+type FollowEvent struct {
+	Time time.Time `json:"time"`
+	// restart or counterReset
+	Kind string `json:"kind"`
+	// The process of the target after the event
+	Pid int `json:"pid"`
+	// The keys of the counters reset
+	Metrics []string `json:"metrics,omitempty"`
+}
+
+// ContainerResult holds the numbers of a container in a Pod
+type ContainerResult struct {
+	ContainerId string                   `json:"containerId"`
+	Pid         int                      `json:"pid"`
+	Command     string                   `json:"command,omitempty"`
+	Metrics     map[string]MetricSummary `json:"metrics"`
+}
+
+// Target identifies the profiled process
+type Target struct {
+	Pid       int    `json:"pid"`
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+	// The command line in exec mode
+	Command string `json:"command,omitempty"`
+	// Where the numbers come from: cgroup or procfs
+	Source string `json:"source"`
+	// The container found by the node agent, from its cgroup path
+	PodUid      string `json:"podUid,omitempty"`
+	ContainerId string `json:"containerId,omitempty"`
+	QosClass    string `json:"qosClass,omitempty"`
+	Cgroup      string `json:"cgroup,omitempty"`
+}
+
+// MetricSummary holds the analytic numbers of a metric, all in Unit
+type MetricSummary struct {
+	Unit string  `json:"unit"`
+	Mean float64 `json:"mean"`
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	// keyed by "p" and the percentile, e.g. "p95" or "p99.9"
+	Percentiles map[string]float64 `json:"percentiles"`
+	// The intervals of a counter across a reset or a wrap, left out of its rates
+	ExcludedIntervals int `json:"excludedIntervals,omitempty"`
+}
+
+func percentileKey(p float64) string {
+	return "p" + strconv.FormatFloat(p, 'f', -1, 64)
+}
+
+// scaledValues turns a series of raw numbers into the unit of the metric, counters are turned into rates first.
+// It also returns the intervals of a counter left out across resets.
+func scaledValues(m metric, data []float64, ms int) ([]float64, int) {
+
+	values, excluded := data, 0
+	if m.counter {
+		values, excluded = countRates(data, ms)
+	}
+
+	scaled := make([]float64, len(values))
+	for i, v := range values {
+		scaled[i] = v * m.scale
+	}
+	return scaled, excluded
+}
+
+// summarize analyzes a series of raw numbers
+func summarize(m metric, data []float64, ms int, pert float64) MetricSummary {
+
+	scaled, excluded := scaledValues(m, data, ms)
+
+	summary := MetricSummary{Unit: m.unitName, Percentiles: make(map[string]float64), ExcludedIntervals: excluded}
+	// stats returns NaN for no input, which JSON cannot carry
+	if len(scaled) == 0 {
+		return summary
+	}
+	summary.Mean, _ = stats.Mean(scaled)
+	summary.Min, _ = stats.Min(scaled)
+	summary.Max, _ = stats.Max(scaled)
+
+	for _, p := range append(defaultPercentiles, pert) {
+		summary.Percentiles[percentileKey(p)], _ = stats.Percentile(scaled, p)
+	}
+	return summary
+}
+
+// nodeName returns the Kubernetes node from NODE_NAME set by the downward API, or the hostname
+func nodeName() string {
+	if node := os.Getenv("NODE_NAME"); node != "" {
+		return node
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+// newTarget identifies the target, the namespace and Pod come from the API ID <namespace>.<pod>.<pid>
+func newTarget(s Scraper, command []string) Target {
+
+	t := Target{Source: "cgroup", Command: strings.Join(command, " ")}
+	t.Pid, _ = strconv.Atoi(s.pid)
+	if s.procfs {
+		t.Source = "procfs"
+	}
+
+	if strings.HasPrefix(s.out, "api:") {
+		id := strings.Split(s.out[4:], ".")
+		if len(id) >= 3 {
+			t.Namespace = id[0]
+			t.Pod = strings.Join(id[1:len(id)-1], ".")
+		}
+	}
+	return t
+}
+
+// labels identifies the target of the work name in time series: name, pid, node, namespace and pod when known,
+// and pod_uid, container_id and qos_class in agent mode
+func (t Target) labels(name string) [][2]string {
+	labels := [][2]string{{"name", name}, {"pid", strconv.Itoa(t.Pid)}, {"node", nodeName()}}
+	if t.Namespace != "" {
+		labels = append(labels, [2]string{"namespace", t.Namespace})
+	}
+	if t.Pod != "" {
+		labels = append(labels, [2]string{"pod", t.Pod})
+	}
+	if t.ContainerId != "" {
+		labels = append(labels, [2]string{"pod_uid", t.PodUid}, [2]string{"container_id", t.ContainerId}, [2]string{"qos_class", t.QosClass})
+	}
+	return labels
+}
+
+func newResult(name string, s Scraper, target Target, c *capture) *Result {
+
+	r := &Result{
+		SchemaVersion: ResultSchemaVersion,
+		Name:          name,
+		Target:        target,
+		Node:          nodeName(),
+		CgroupVersion: cgroupVersion,
+		SpanMs:        s.ms,
+		Samples:       c.samples(),
+		Start:         c.start.UTC(),
+		End:           c.end.UTC(),
+		Interrupted:   s.interrupted(),
+		Metrics:       make(map[string]MetricSummary),
+		Events:        c.events,
+	}
+
+	for i, m := range c.metrics {
+		if trendOnly(m) {
+			continue
+		}
+		summary := summarize(m, c.series[i], s.ms, s.pert)
+		if m.target != nil {
+			// the metrics of a target are next to each other
+			n := len(r.Targets)
+			if n == 0 || r.Targets[n-1].Target.Pid != m.target.Pid {
+				r.Targets = append(r.Targets, TargetResult{Target: *m.target, Metrics: make(map[string]MetricSummary)})
+				n++
+			}
+			r.Targets[n-1].Metrics[m.key] = summary
+			continue
+		}
+		if m.container == nil {
+			r.Metrics[m.key] = summary
+			continue
+		}
+		// the metrics of a container are next to each other
+		n := len(r.Containers)
+		if n == 0 || r.Containers[n-1].ContainerId != m.container.containerId {
+			r.Containers = append(r.Containers, ContainerResult{
+				ContainerId: m.container.containerId,
+				Pid:         m.container.pid,
+				Command:     m.container.command,
+				Metrics:     make(map[string]MetricSummary),
+			})
+			n++
+		}
+		r.Containers[n-1].Metrics[m.key] = summary
+	}
+
+	if combined := c.combine(); combined != nil {
+		for i, m := range combined.metrics {
+			if trendOnly(m) {
+				continue
+			}
+			r.Metrics[m.key] = summarize(m, combined.series[i], s.ms, s.pert)
+		}
+	}
+	r.Correlations = correlate(c, s.ms)
+	r.Trends = trends(c, s.ms)
+	r.MemoryTrend = memoryTrend(c, s.ms, s.memLimit)
+	return r
+}
+
+func (r *Result) marshal() ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
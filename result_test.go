@@ -0,0 +1,89 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSummarize(t *testing.T) {
+
+	hundred := make([]float64, 100)
+	for i := range hundred {
+		hundred[i] = float64(i + 1)
+	}
+	tests := []struct {
+		name string
+		m    metric
+		data []float64
+		pert float64
+		want MetricSummary
+	}{
+		{"gauge", memMetric, hundred, 99.9, MetricSummary{
+			Unit: "bytes", Mean: 50.5, Min: 1, Max: 100,
+			Percentiles: map[string]float64{"p50": 50, "p90": 90, "p95": 95, "p99": 99, "p99.9": 99.5},
+		}},
+		// bytes per millisecond of a span of 10ms to bytes per second, the interval across the reset left out
+		{"counter", egressMetric, []float64{0, 10, 30, 60, 5, 45}, 95, MetricSummary{
+			Unit: "bytes/s", Mean: 2500, Min: 1000, Max: 4000,
+			// a whole rank takes the number at it, a fractional one the mean of the two around it
+			Percentiles:       map[string]float64{"p50": 2000, "p90": 3500, "p95": 3500, "p99": 3500},
+			ExcludedIntervals: 1,
+		}},
+		{"no samples", memMetric, nil, 95, MetricSummary{Unit: "bytes", Percentiles: map[string]float64{}}},
+		{"single sample of a counter", egressMetric, []float64{5}, 95, MetricSummary{Unit: "bytes/s", Percentiles: map[string]float64{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := summarize(tt.m, tt.data, 10, tt.pert)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("summarize() = %+v, want %+v", got, tt.want)
+			}
+			// no NaN, which JSON cannot carry
+			if _, err := json.Marshal(got); err != nil {
+				t.Errorf("summary cannot be marshaled: %v", err)
+			}
+		})
+	}
+}
+
+func TestPercentileKey(t *testing.T) {
+	for p, want := range map[float64]string{95: "p95", 99.9: "p99.9", 50: "p50", 99.99: "p99.99"} {
+		if got := percentileKey(p); got != want {
+			t.Errorf("percentileKey(%v) = %q, want %q", p, got, want)
+		}
+	}
+}
+
+func TestNewTarget(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		s       Scraper
+		command []string
+		want    Target
+	}{
+		{"api", Scraper{pid: "42", out: "api:prod.web.v2.42"}, nil, Target{Pid: 42, Namespace: "prod", Pod: "web.v2", Source: "cgroup"}},
+		{"file", Scraper{pid: "42", out: "file:app"}, nil, Target{Pid: 42, Source: "cgroup"}},
+		{"exec", Scraper{pid: "7", out: "none", procfs: true}, []string{"sleep", "1"}, Target{Pid: 7, Source: "procfs", Command: "sleep 1"}},
+	}
+	for _, tt := range tests {
+		if got := newTarget(tt.s, tt.command); got != tt.want {
+			t.Errorf("%s: newTarget() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
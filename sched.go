@@ -0,0 +1,143 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The scheduler collector, enabled by --sched, samples what CPU usage does not show: the time the threads
+// of the target wait on the run queue, from /proc/<pid>/task/<tid>/schedstat, and their voluntary and
+// involuntary context switches, from /proc/<pid>/task/<tid>/status.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+var (
+	// the run delay is in nanoseconds, per millisecond to the share of time
+	runDelayMetric    = metric{"Run delay", "run_delay", "run_delay", true, transPercent(1e-4), "percent", 1e-4, nil, nil}
+	voluntaryMetric   = metric{"Voluntary switches", "vcsw", "voluntary_switches", true, transRate(1000), "switches/s", 1000, nil, nil}
+	involuntaryMetric = metric{"Involuntary switches", "nvcsw", "involuntary_switches", true, transRate(1000), "switches/s", 1000, nil, nil}
+	schedMetrics      = []metric{runDelayMetric, voluntaryMetric, involuntaryMetric}
+	contextSwitchKeys = []string{"voluntary_ctxt_switches:", "nonvoluntary_ctxt_switches:"}
+)
+
+func transRate(scale float64) func(float64) string {
+	return func(v float64) string {
+		return fmt.Sprintf("%.0f", v*scale)
+	}
+}
+
+// schedCounters sums the numbers of the threads of the target, as counters.
+// Threads come and go, so only the increase of threads read on both ticks is added.
+type schedCounters struct {
+	pid       string
+	max       int
+	truncated bool
+	last      map[string][3]float64
+	total     [3]float64
+}
+
+// newSchedCollector reads the run delay and context switches of all threads of the process
+func newSchedCollector(pid string, max int) (collector, error) {
+
+	if _, err := readSchedstat(procPath(pid, "schedstat")); err != nil {
+		return collector{}, newError(errTarget, "no scheduler statistics of process %s, it needs a kernel with schedstats: %v", pid, err)
+	}
+	sc := &schedCounters{pid: pid, max: max, last: make(map[string][3]float64)}
+	if _, err := sc.read(); err != nil {
+		return collector{}, fileError(errTarget, err)
+	}
+	return collector{
+		metrics: schedMetrics,
+		read:    sc.read,
+	}, nil
+}
+
+func (sc *schedCounters) read() ([]float64, error) {
+
+	entries, err := os.ReadDir(procPath(sc.pid, "task"))
+	if err != nil {
+		return nil, err
+	}
+
+	current := make(map[string][3]float64)
+	for _, e := range entries {
+		tid := e.Name()
+		if _, ok := sc.last[tid]; !ok && len(current) >= sc.max {
+			if !sc.truncated {
+				log.Printf("Process %s has more than %d threads, the others are not sampled for the scheduler", sc.pid, sc.max)
+				sc.truncated = true
+			}
+			continue
+		}
+		numbers, err := readTaskSched(procPath(sc.pid, "task/"+tid))
+		if err != nil {
+			// the thread is gone
+			continue
+		}
+		if last, ok := sc.last[tid]; ok {
+			for i := range numbers {
+				if numbers[i] >= last[i] {
+					sc.total[i] += numbers[i] - last[i]
+				}
+			}
+		}
+		current[tid] = numbers
+	}
+	sc.last = current
+	return []float64{sc.total[0], sc.total[1], sc.total[2]}, nil
+}
+
+// readTaskSched returns the run delay, voluntary and involuntary context switches of a thread
+func readTaskSched(dir string) ([3]float64, error) {
+
+	var numbers [3]float64
+	delay, err := readSchedstat(dir + "/schedstat")
+	if err != nil {
+		return numbers, err
+	}
+	numbers[0] = delay
+
+	content, err := os.ReadFile(dir + "/status")
+	if err != nil {
+		return numbers, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		for i, key := range contextSwitchKeys {
+			if fields[0] == key {
+				numbers[1+i] = stringToFloat(fields[1])
+			}
+		}
+	}
+	return numbers, nil
+}
+
+// readSchedstat returns the time waited on the run queue in nanoseconds, the second number of schedstat
+func readSchedstat(path string) (float64, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) < 3 {
+		return 0, fmt.Errorf("malformed %s", path)
+	}
+	return stringToFloat(fields[1]), nil
+}
@@ -0,0 +1,358 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Colibri API server, "colibri server [flags]", receives result documents at
+//   POST /colibri/<namespace>.<pod>.<pid>
+// and serves them per Pod and container at
+//   GET  /colibri/                                   index of Pods and containers with results
+//   GET  /colibri/<namespace>/<pod>[/<container>]    results, filtered by ?since=&until=&limit=
+//   GET  /colibri/<namespace>/<pod>/<container>/latest
+//   GET  /colibri/<namespace>/<pod>/<container>/<id>
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	apiPrefix = "/colibri/"
+	// result documents are small, anything larger is not one
+	maxResultSize = 1 << 20
+)
+
+// namespaces, Pods and containers are DNS labels or subdomains, which also keeps them safe as directory names
+var nameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+
+type apiServer struct {
+	lookup podLookup
+	store  resultStore
+}
+
+func runServer(args []string) error {
+
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	listen := fs.String("listen", ":8080", "The address to listen on")
+	storeDir := fs.String("store", "/var/lib/colibri", "The directory storing received results")
+	podsFile := fs.String("pods-file", "", "A JSON list of Pods to accept, instead of asking Kubernetes. For tests and running without Kubernetes")
+	fs.Parse(args)
+
+	var lookup podLookup
+	var err error
+	if *podsFile != "" {
+		lookup, err = loadStaticLookup(*podsFile)
+	} else {
+		lookup, err = newKubeLookup()
+	}
+	if err != nil {
+		return err
+	}
+
+	store, err := newFileStore(*storeDir)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Addr:              *listen,
+		Handler:           &apiServer{lookup, store},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-sigs
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	log.Printf("Colibri API server listens on %s, storing results in %s", *listen, *storeDir)
+	if err = srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return newError(errUsage, "cannot serve: %v", err)
+	}
+	return nil
+}
+
+func (a *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Path == "/healthz" {
+		io.WriteString(w, "ok\n")
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, apiPrefix) && r.URL.Path != strings.TrimSuffix(apiPrefix, "/") {
+		httpError(w, http.StatusNotFound, "not found")
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(apiPrefix, "/")), "/")
+
+	switch r.Method {
+	case http.MethodPost:
+		a.receive(w, r, rest)
+	case http.MethodGet:
+		a.query(w, r, rest)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// parseResultId splits <namespace>.<pod>.<pid>, Pod names may contain dots
+func parseResultId(id string) (string, string, int, error) {
+
+	parts := strings.Split(id, ".")
+	if len(parts) < 3 {
+		return "", "", 0, fmt.Errorf("identifier %q is not <namespace>.<pod>.<pid>", id)
+	}
+
+	namespace := parts[0]
+	pod := strings.Join(parts[1:len(parts)-1], ".")
+	pid, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil || pid <= 0 {
+		return "", "", 0, fmt.Errorf("identifier %q has no valid process ID", id)
+	}
+	if !nameRegexp.MatchString(namespace) || !nameRegexp.MatchString(pod) {
+		return "", "", 0, fmt.Errorf("identifier %q has invalid namespace or Pod name", id)
+	}
+	return namespace, pod, pid, nil
+}
+
+func (a *apiServer) receive(w http.ResponseWriter, r *http.Request, id string) {
+
+	namespace, pod, pid, err := parseResultId(id)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result := &Result{}
+	if err = json.NewDecoder(io.LimitReader(r.Body, maxResultSize)).Decode(result); err != nil {
+		httpError(w, http.StatusBadRequest, "malformed result document: "+err.Error())
+		return
+	}
+	if result.SchemaVersion != ResultSchemaVersion {
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("unsupported schema version %q, expecting %q", result.SchemaVersion, ResultSchemaVersion))
+		return
+	}
+
+	// the document must describe the identified process
+	t := result.Target
+	if t.Pid != pid || (t.Namespace != "" && t.Namespace != namespace) || (t.Pod != "" && t.Pod != pod) {
+		httpError(w, http.StatusBadRequest, "result document does not match identifier "+id)
+		return
+	}
+
+	info, err := a.lookup.lookupPod(namespace, pod)
+	if err != nil {
+		log.Print("Cannot look up Pod: ", err)
+		httpError(w, http.StatusBadGateway, "cannot look up Pod")
+		return
+	}
+	if info == nil {
+		log.Printf("Blocking result %s: no such Pod", id)
+		httpError(w, http.StatusUnprocessableEntity, fmt.Sprintf("Pod %s/%s does not exist", namespace, pod))
+		return
+	}
+	if result.Node != "" && info.Node != "" && result.Node != info.Node {
+		log.Printf("Blocking result %s: profiled on node %s but Pod runs on %s", id, result.Node, info.Node)
+		httpError(w, http.StatusUnprocessableEntity, fmt.Sprintf("Pod %s/%s does not run on node %s", namespace, pod, result.Node))
+		return
+	}
+
+	container, err := resolveContainer(info, result.Name)
+	if err != nil {
+		httpError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	stored := &storedResult{
+		Namespace: namespace,
+		Pod:       pod,
+		Container: container,
+		Received:  time.Now().UTC(),
+		Result:    result,
+	}
+	if err = a.store.put(stored); err != nil {
+		log.Print("Cannot store result: ", err)
+		httpError(w, http.StatusInternalServerError, "cannot store result")
+		return
+	}
+
+	log.Printf("Stored result %s of %s/%s/%s", stored.Id, namespace, pod, container)
+	writeJSON(w, http.StatusCreated, map[string]string{"id": stored.Id, "container": container})
+}
+
+// resolveContainer picks the container by the name of the work (--name), which tells containers of a Pod apart.
+// A Pod of a single container needs no name.
+func resolveContainer(info *PodInfo, name string) (string, error) {
+	for _, c := range info.Containers {
+		if c == name {
+			return c, nil
+		}
+	}
+	if len(info.Containers) == 1 {
+		return info.Containers[0], nil
+	}
+	return "", fmt.Errorf("name %q matches no container of Pod %s/%s, expecting one of %v",
+		name, info.Namespace, info.Name, info.Containers)
+}
+
+func (a *apiServer) query(w http.ResponseWriter, r *http.Request, path string) {
+
+	var parts []string
+	if path != "" {
+		parts = strings.Split(path, "/")
+	}
+
+	switch len(parts) {
+	case 0:
+		a.index(w)
+		return
+	case 1, 2, 3, 4:
+	default:
+		httpError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	for _, p := range parts {
+		if !nameRegexp.MatchString(p) {
+			httpError(w, http.StatusBadRequest, fmt.Sprintf("invalid name %q", p))
+			return
+		}
+	}
+
+	q := resultQuery{namespace: parts[0]}
+	if len(parts) > 1 {
+		q.pod = parts[1]
+	}
+	if len(parts) > 2 {
+		q.container = parts[2]
+	}
+
+	single := len(parts) == 4
+	if single {
+		if parts[3] == "latest" {
+			q.limit = 1
+		} else {
+			q.id = parts[3]
+		}
+	} else if err := parseQueryParams(r, &q); err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	results, err := a.store.list(q)
+	if err != nil {
+		log.Print("Cannot list results: ", err)
+		httpError(w, http.StatusInternalServerError, "cannot list results")
+		return
+	}
+
+	if !single {
+		if results == nil {
+			results = []*storedResult{}
+		}
+		writeJSON(w, http.StatusOK, results)
+		return
+	}
+	if len(results) == 0 {
+		httpError(w, http.StatusNotFound, "no such result")
+		return
+	}
+	writeJSON(w, http.StatusOK, results[len(results)-1])
+}
+
+func parseQueryParams(r *http.Request, q *resultQuery) error {
+
+	values := r.URL.Query()
+	var err error
+
+	if v := values.Get("since"); v != "" {
+		if q.since, err = time.Parse(time.RFC3339, v); err != nil {
+			return fmt.Errorf("since must be an RFC 3339 time: %v", err)
+		}
+	}
+	if v := values.Get("until"); v != "" {
+		if q.until, err = time.Parse(time.RFC3339, v); err != nil {
+			return fmt.Errorf("until must be an RFC 3339 time: %v", err)
+		}
+	}
+	if v := values.Get("limit"); v != "" {
+		if q.limit, err = strconv.Atoi(v); err != nil || q.limit <= 0 {
+			return fmt.Errorf("limit must be a positive number, got %q", v)
+		}
+	}
+	return nil
+}
+
+// index lists the Pods and containers having results, with their numbers
+func (a *apiServer) index(w http.ResponseWriter) {
+
+	results, err := a.store.list(resultQuery{})
+	if err != nil {
+		log.Print("Cannot list results: ", err)
+		httpError(w, http.StatusInternalServerError, "cannot list results")
+		return
+	}
+
+	type entry struct {
+		Namespace string    `json:"namespace"`
+		Pod       string    `json:"pod"`
+		Container string    `json:"container"`
+		Results   int       `json:"results"`
+		Latest    time.Time `json:"latest"`
+	}
+
+	entries := []*entry{}
+	seen := make(map[string]*entry)
+	for _, r := range results {
+		key := r.Namespace + "/" + r.Pod + "/" + r.Container
+		e, ok := seen[key]
+		if !ok {
+			e = &entry{Namespace: r.Namespace, Pod: r.Pod, Container: r.Container}
+			seen[key] = e
+			entries = append(entries, e)
+		}
+		e.Results++
+		// results are sorted by start time
+		e.Latest = r.Result.Start
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func httpError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
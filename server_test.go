@@ -0,0 +1,280 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseResultId(t *testing.T) {
+
+	tests := []struct {
+		id             string
+		namespace, pod string
+		pid            int
+		ok             bool
+	}{
+		{"default.web.42", "default", "web", 42, true},
+		{"prod.web.v1.2.7", "prod", "web.v1.2", 7, true},
+		{"default.web", "", "", 0, false},
+		{"default.web.abc", "", "", 0, false},
+		{"default.web.0", "", "", 0, false},
+		{"default.web.-3", "", "", 0, false},
+		{"Default.web.1", "", "", 0, false},
+		{"default.web_1.1", "", "", 0, false},
+		{"default..1", "", "", 0, false},
+	}
+	for _, tt := range tests {
+		namespace, pod, pid, err := parseResultId(tt.id)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseResultId(%q) error = %v, want ok %v", tt.id, err, tt.ok)
+			continue
+		}
+		if namespace != tt.namespace || pod != tt.pod || pid != tt.pid {
+			t.Errorf("parseResultId(%q) = %q, %q, %d, want %q, %q, %d", tt.id, namespace, pod, pid, tt.namespace, tt.pod, tt.pid)
+		}
+	}
+}
+
+// newTestServer serves a store in a temporary directory, accepting the Pods given
+func newTestServer(t *testing.T, pods ...*PodInfo) (*httptest.Server, string) {
+	dir := t.TempDir()
+	store, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(&apiServer{newStaticLookup(pods...), store})
+	t.Cleanup(srv.Close)
+	return srv, dir
+}
+
+func testResult(pid int, name string, start time.Time) *Result {
+	return &Result{
+		SchemaVersion: ResultSchemaVersion,
+		Name:          name,
+		Target:        Target{Pid: pid, Source: "cgroup"},
+		Node:          "node-1",
+		Start:         start,
+		End:           start.Add(time.Second),
+	}
+}
+
+func post(t *testing.T, srv *httptest.Server, id string, body interface{}) (int, map[string]string) {
+	t.Helper()
+	var content string
+	if s, ok := body.(string); ok {
+		content = s
+	} else {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content = string(b)
+	}
+	resp, err := http.Post(srv.URL+apiPrefix+id, "application/json", strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reply := map[string]string{}
+	json.NewDecoder(resp.Body).Decode(&reply)
+	return resp.StatusCode, reply
+}
+
+func get(t *testing.T, srv *httptest.Server, path string, v interface{}) int {
+	t.Helper()
+	resp, err := http.Get(srv.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestServerReceive(t *testing.T) {
+
+	srv, _ := newTestServer(t,
+		&PodInfo{Namespace: "default", Name: "web", Node: "node-1", Containers: []string{"app", "sidecar"}},
+		&PodInfo{Namespace: "default", Name: "db", Node: "node-2", Containers: []string{"postgres"}},
+	)
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	wrongSchema := testResult(42, "app", start)
+	wrongSchema.SchemaVersion = "0"
+
+	tests := []struct {
+		name      string
+		id        string
+		body      interface{}
+		status    int
+		container string
+	}{
+		{"by name", "default.web.42", testResult(42, "app", start), http.StatusCreated, "app"},
+		{"other node", "default.db.7", testResult(7, "birdy", start), http.StatusUnprocessableEntity, ""},
+		{"unknown name", "default.web.42", testResult(42, "birdy", start), http.StatusUnprocessableEntity, ""},
+		{"unknown Pod", "default.api.42", testResult(42, "app", start), http.StatusUnprocessableEntity, ""},
+		{"pid mismatch", "default.web.43", testResult(42, "app", start), http.StatusBadRequest, ""},
+		{"bad identifier", "default.web", testResult(42, "app", start), http.StatusBadRequest, ""},
+		{"schema", "default.web.42", wrongSchema, http.StatusBadRequest, ""},
+		{"malformed", "default.web.42", "{", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, reply := post(t, srv, tt.id, tt.body)
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d: %v", status, tt.status, reply)
+			}
+			if tt.container != "" && (reply["container"] != tt.container || reply["id"] == "") {
+				t.Errorf("reply = %v, want container %q and an ID", reply, tt.container)
+			}
+		})
+	}
+
+	// a Pod of a single container needs no name of the work
+	r := testResult(7, "birdy", start)
+	r.Node = "node-2"
+	if status, reply := post(t, srv, "default.db.7", r); status != http.StatusCreated || reply["container"] != "postgres" {
+		t.Errorf("single container = %d %v, want %d with container postgres", status, reply, http.StatusCreated)
+	}
+}
+
+func TestServerQuery(t *testing.T) {
+
+	srv, _ := newTestServer(t, &PodInfo{Namespace: "default", Name: "web", Node: "node-1", Containers: []string{"app", "sidecar"}})
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	var ids []string
+	for i, name := range []string{"app", "app", "sidecar", "app"} {
+		status, reply := post(t, srv, "default.web.42", testResult(42, name, start.Add(time.Duration(i)*time.Hour)))
+		if status != http.StatusCreated {
+			t.Fatalf("status = %d, want %d: %v", status, http.StatusCreated, reply)
+		}
+		ids = append(ids, reply["id"])
+	}
+
+	tests := []struct {
+		path   string
+		status int
+		ids    []string
+	}{
+		{"/colibri/default/web", http.StatusOK, ids},
+		{"/colibri/default/web/app", http.StatusOK, []string{ids[0], ids[1], ids[3]}},
+		{"/colibri/default/web/app?limit=2", http.StatusOK, []string{ids[1], ids[3]}},
+		{"/colibri/default/web/app?since=2022-05-01T10:30:00Z&until=2022-05-01T12:00:00Z", http.StatusOK, []string{ids[1]}},
+		{"/colibri/default/api", http.StatusOK, []string{}},
+		{"/colibri/default/web/app?limit=0", http.StatusBadRequest, nil},
+		{"/colibri/default/web/app?since=yesterday", http.StatusBadRequest, nil},
+		{"/colibri/default/Web", http.StatusBadRequest, nil},
+		{"/colibri/default/web/app/latest/more", http.StatusNotFound, nil},
+		{"/other", http.StatusNotFound, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			var results []*storedResult
+			status := get(t, srv, tt.path, &results)
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+			if status != http.StatusOK {
+				return
+			}
+			got := []string{}
+			for _, r := range results {
+				got = append(got, r.Id)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.ids, ",") {
+				t.Errorf("IDs = %v, want %v", got, tt.ids)
+			}
+		})
+	}
+
+	var latest storedResult
+	if status := get(t, srv, "/colibri/default/web/app/latest", &latest); status != http.StatusOK || latest.Id != ids[3] {
+		t.Errorf("latest = %d %q, want %d %q", status, latest.Id, http.StatusOK, ids[3])
+	}
+	var single storedResult
+	if status := get(t, srv, "/colibri/default/web/sidecar/"+ids[2], &single); status != http.StatusOK || single.Result.Name != "sidecar" {
+		t.Errorf("by ID = %d %+v, want %d of sidecar", status, single, http.StatusOK)
+	}
+	if status := get(t, srv, "/colibri/default/web/app/"+ids[2], &single); status != http.StatusNotFound {
+		t.Errorf("ID of another container = %d, want %d", status, http.StatusNotFound)
+	}
+
+	var index []struct {
+		Container string    `json:"container"`
+		Results   int       `json:"results"`
+		Latest    time.Time `json:"latest"`
+	}
+	if status := get(t, srv, "/colibri/", &index); status != http.StatusOK || len(index) != 2 {
+		t.Fatalf("index = %d %+v, want 2 containers", status, index)
+	}
+	for _, e := range index {
+		want := map[string]int{"app": 3, "sidecar": 1}[e.Container]
+		if e.Results != want {
+			t.Errorf("index of %s has %d results, want %d", e.Container, e.Results, want)
+		}
+	}
+}
+
+func TestFileStorePersistence(t *testing.T) {
+
+	dir := t.TempDir()
+	store, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		r := &storedResult{Namespace: "default", Pod: "web", Container: "app", Received: start, Result: testResult(42, "app", start.Add(-time.Duration(i)*time.Minute))}
+		if err = store.put(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a new store over the same directory reads what the first one wrote
+	reopened, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := reopened.list(resultQuery{namespace: "default", pod: "web", container: "app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("listed %d results, want 3", len(results))
+	}
+	for i := 1; i < len(results); i++ {
+		if !results[i-1].Result.Start.Before(results[i].Result.Start) {
+			t.Errorf("results are not sorted by start time: %v before %v", results[i-1].Result.Start, results[i].Result.Start)
+		}
+		if results[i-1].Id == results[i].Id {
+			t.Errorf("duplicate ID %s", results[i].Id)
+		}
+	}
+	if !strings.HasSuffix(results[0].Id, "-42") {
+		t.Errorf("ID %s does not end with the process ID", results[0].Id)
+	}
+	if other, _ := reopened.list(resultQuery{container: "sidecar"}); len(other) != 0 {
+		t.Errorf("listed %d results of another container, want none", len(other))
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// exitInterrupted is the exit code of a run stopped by SIGTERM or SIGINT, after partial results are flushed
+const exitInterrupted = 3
+
+// watchInterrupt returns a channel closed on the first SIGTERM or SIGINT, e.g. when a Job is deleted
+// or reaches activeDeadlineSeconds. The collection stops and the partial results are flushed.
+// A second signal exits immediately.
+func watchInterrupt() <-chan struct{} {
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+
+	interrupt := make(chan struct{})
+
+	go func() {
+		sig := <-sigs
+		log.Printf("Received %s, stopping the collection and flushing partial results", sig)
+		close(interrupt)
+
+		sig = <-sigs
+		log.Printf("Received %s again, exiting without flushing", sig)
+		os.Exit(exitInterrupted)
+	}()
+
+	return interrupt
+}
@@ -0,0 +1,159 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// storedResult is a result document accepted by Colibri API server
+type storedResult struct {
+	Id        string    `json:"id"`
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod"`
+	Container string    `json:"container"`
+	Received  time.Time `json:"received"`
+	Result    *Result   `json:"result"`
+}
+
+// resultQuery selects stored results, empty fields match everything
+type resultQuery struct {
+	namespace, pod, container, id string
+	// on the start time of results
+	since, until time.Time
+	// the latest ones are kept if there are more
+	limit int
+}
+
+func (q resultQuery) match(r *storedResult) bool {
+	switch {
+	case q.namespace != "" && q.namespace != r.Namespace,
+		q.pod != "" && q.pod != r.Pod,
+		q.container != "" && q.container != r.Container,
+		q.id != "" && q.id != r.Id,
+		!q.since.IsZero() && r.Result.Start.Before(q.since),
+		!q.until.IsZero() && r.Result.Start.After(q.until):
+		return false
+	}
+	return true
+}
+
+type resultStore interface {
+	put(r *storedResult) error
+	// list returns the matched results sorted by start time
+	list(q resultQuery) ([]*storedResult, error)
+}
+
+// fileStore keeps results as <dir>/<namespace>/<pod>/<container>/<id>.json
+type fileStore struct {
+	dir string
+	// guards id generation
+	mu   sync.Mutex
+	last int64
+}
+
+func newFileStore(dir string) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fileError(errOutput, err)
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+// newId returns an increasing ID from the receiving time
+func (s *fileStore) newId(pid int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := time.Now().UnixNano()
+	if id <= s.last {
+		id = s.last + 1
+	}
+	s.last = id
+	return strconv.FormatInt(id, 10) + "-" + strconv.Itoa(pid)
+}
+
+func (s *fileStore) put(r *storedResult) error {
+
+	r.Id = s.newId(r.Result.Target.Pid)
+
+	dir := filepath.Join(s.dir, r.Namespace, r.Pod, r.Container)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fileError(errOutput, err)
+	}
+
+	content, err := json.Marshal(r)
+	if err != nil {
+		return &Error{errInternal, err}
+	}
+
+	name := filepath.Join(dir, r.Id+".json")
+	if err = os.WriteFile(name+".tmp", content, 0644); err != nil {
+		return fileError(errOutput, err)
+	}
+	if err = os.Rename(name+".tmp", name); err != nil {
+		return fileError(errOutput, err)
+	}
+	return nil
+}
+
+func (s *fileStore) list(q resultQuery) ([]*storedResult, error) {
+
+	// narrow down the directories to read with the known parts of the query
+	pattern := []string{s.dir, "*", "*", "*", "*.json"}
+	for i, part := range []string{q.namespace, q.pod, q.container, q.id} {
+		if part != "" {
+			pattern[i+1] = part
+		}
+	}
+	if q.id != "" {
+		pattern[4] = q.id + ".json"
+	}
+
+	files, err := filepath.Glob(filepath.Join(pattern...))
+	if err != nil {
+		return nil, &Error{errInternal, err}
+	}
+
+	var results []*storedResult
+	for _, f := range files {
+		content, err := os.ReadFile(f)
+		if err != nil {
+			// removed in between
+			continue
+		}
+		r := &storedResult{}
+		if err = json.Unmarshal(content, r); err != nil || r.Result == nil {
+			continue
+		}
+		if q.match(r) {
+			results = append(results, r)
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Result.Start.Before(results[j].Result.Start)
+	})
+
+	if q.limit > 0 && len(results) > q.limit {
+		results = results[len(results)-q.limit:]
+	}
+	return results, nil
+}
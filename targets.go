@@ -0,0 +1,53 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Several targets, given by repeating --pid or --wait-for, are sampled on the same tick by one Colibri,
+// e.g. to study the interference between co-located functions. Their series share the timestamps,
+// and the result document has the numbers of every target besides their sums.
+
+// newTargetCollectors reads every target with its own collectors, in the order of pids
+func (s Scraper) newTargetCollectors(pids []string, metricType string, iface string) ([]collector, error) {
+
+	var collectors []collector
+	for _, pid := range pids {
+		ts := s
+		ts.pid = pid
+		procfs, err := useProcfs(pid)
+		if err != nil {
+			return nil, err
+		}
+		ts.procfs = procfs
+
+		targetCollectors, err := ts.newCollectors(metricType, iface)
+		if err != nil {
+			return nil, err
+		}
+		target := newTarget(ts, nil)
+		// the metrics of targets are told apart in outputs by their targets
+		for i := range targetCollectors {
+			c := &targetCollectors[i]
+			metrics := make([]metric, len(c.metrics))
+			for j, m := range c.metrics {
+				m.target = &target
+				m.file = pid + "_" + m.file
+				metrics[j] = m
+			}
+			c.metrics = metrics
+		}
+		collectors = append(collectors, targetCollectors...)
+	}
+	return collectors, nil
+}
@@ -0,0 +1,261 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The task breakdown, enabled by --top, tells which processes and threads of the target burn the CPU.
+// The process tree under the target is walked by /proc/<pid>/task/<tid>/children, and the CPU time of
+// every process and thread in it is read from their stat files on every tick.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the interval of walking the process tree again for new descendants
+const taskRescanInterval = time.Second
+
+// taskCpu is the CPU time of a process or a thread in clock ticks
+type taskCpu struct {
+	pid, tid int
+	command  string
+	// the ticks at the start of the window, and the last ones read
+	base, last float64
+	gone       bool
+}
+
+type taskTracker struct {
+	root     string
+	top, max int
+
+	// the emitter of daemon mode takes the breakdown from another goroutine
+	mu        sync.Mutex
+	nextScan  time.Time
+	scanned   bool
+	truncated bool
+	start     time.Time
+	procs     map[int]*taskCpu
+	threads   map[int]*taskCpu
+}
+
+func newTaskTracker(pid string, top int, max int) *taskTracker {
+	return &taskTracker{root: pid, top: top, max: max, procs: make(map[int]*taskCpu), threads: make(map[int]*taskCpu)}
+}
+
+// collector reads the tasks on the tick of sampling, it adds no values
+func (tt *taskTracker) collector() collector {
+	return collector{
+		read: func() ([]float64, error) {
+			tt.read(time.Now())
+			return nil, nil
+		},
+	}
+}
+
+func (tt *taskTracker) read(t time.Time) {
+
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	if tt.start.IsZero() {
+		tt.start = t
+	}
+	if !t.Before(tt.nextScan) {
+		tt.scan()
+		tt.nextScan = t.Add(taskRescanInterval)
+	}
+
+	for _, tasks := range []map[int]*taskCpu{tt.procs, tt.threads} {
+		for _, task := range tasks {
+			if task.gone {
+				continue
+			}
+			if _, ticks, err := readTaskStat(task.statPath()); err != nil {
+				task.gone = true
+			} else {
+				task.last = ticks
+			}
+		}
+	}
+}
+
+// scan walks the process tree from the root, up to the limit of threads.
+// The tasks found after the first scan are born since, their whole CPU time counts.
+func (tt *taskTracker) scan() {
+
+	queue := []int{}
+	if pid, err := strconv.Atoi(tt.root); err == nil {
+		queue = append(queue, pid)
+	}
+	visited := make(map[int]bool)
+
+	for len(queue) > 0 {
+		pid := queue[0]
+		queue = queue[1:]
+		if visited[pid] {
+			continue
+		}
+		visited[pid] = true
+
+		entries, err := os.ReadDir(procPath(strconv.Itoa(pid), "task"))
+		if err != nil {
+			continue
+		}
+		if _, ok := tt.procs[pid]; !ok && tt.full() {
+			continue
+		}
+		tt.add(tt.procs, &taskCpu{pid: pid})
+		for _, e := range entries {
+			tid, err := strconv.Atoi(e.Name())
+			if err != nil {
+				continue
+			}
+			if _, ok := tt.threads[tid]; !ok && tt.full() {
+				continue
+			}
+			tt.add(tt.threads, &taskCpu{pid: pid, tid: tid})
+
+			children, _ := os.ReadFile(procPath(strconv.Itoa(pid), "task/"+e.Name()+"/children"))
+			for _, child := range strings.Fields(string(children)) {
+				if c, err := strconv.Atoi(child); err == nil {
+					queue = append(queue, c)
+				}
+			}
+		}
+	}
+	tt.scanned = true
+}
+
+// full tells the limit of threads is reached, the new tasks are not tracked
+func (tt *taskTracker) full() bool {
+	if len(tt.threads) < tt.max {
+		return false
+	}
+	if !tt.truncated {
+		log.Printf("The target has more than %d threads, the others are not tracked", tt.max)
+		tt.truncated = true
+	}
+	return true
+}
+
+func (tt *taskTracker) add(tasks map[int]*taskCpu, task *taskCpu) {
+
+	id := task.pid
+	if task.tid != 0 {
+		id = task.tid
+	}
+	if known, ok := tasks[id]; ok && !known.gone {
+		return
+	}
+
+	command, ticks, err := readTaskStat(task.statPath())
+	if err != nil {
+		return
+	}
+	task.command, task.last = command, ticks
+	if !tt.scanned {
+		task.base = ticks
+	}
+	tasks[id] = task
+}
+
+func (task *taskCpu) statPath() string {
+	if task.tid == 0 {
+		return procPath(strconv.Itoa(task.pid), "stat")
+	}
+	return procPath(strconv.Itoa(task.pid), "task/"+strconv.Itoa(task.tid)+"/stat")
+}
+
+// readTaskStat returns the command and the user and system CPU time in clock ticks of a stat file
+func readTaskStat(path string) (string, float64, error) {
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", 0, err
+	}
+	stat := string(content)
+	// the command is in parentheses, and may have spaces and parentheses itself
+	open, end := strings.IndexByte(stat, '('), strings.LastIndexByte(stat, ')')
+	if open < 0 || end < open {
+		return "", 0, fmt.Errorf("malformed %s", path)
+	}
+	// the fields from the state, utime and stime are the 14th and 15th of the whole line
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 13 {
+		return "", 0, fmt.Errorf("malformed %s", path)
+	}
+	return stat[open+1 : end], stringToFloat(fields[11]) + stringToFloat(fields[12]), nil
+}
+
+// take returns the busiest processes and threads of the window until t, and starts the next window
+func (tt *taskTracker) take(t time.Time) ([]TaskCpu, []TaskCpu) {
+
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	window := t.Sub(tt.start).Seconds()
+	tt.start = t
+	return topTasks(tt.procs, tt.top, window), topTasks(tt.threads, tt.top, window)
+}
+
+func topTasks(tasks map[int]*taskCpu, top int, window float64) []TaskCpu {
+
+	var result []TaskCpu
+	for id, task := range tasks {
+		seconds := (task.last - task.base) / clockTicks
+		if task.gone {
+			delete(tasks, id)
+		} else {
+			task.base = task.last
+		}
+		if seconds <= 0 {
+			continue
+		}
+		r := TaskCpu{Pid: task.pid, Tid: task.tid, Command: task.command, CpuSeconds: seconds}
+		if window > 0 {
+			r.Millicores = seconds / window * 1000
+		}
+		result = append(result, r)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].CpuSeconds != result[j].CpuSeconds {
+			return result[i].CpuSeconds > result[j].CpuSeconds
+		}
+		if result[i].Pid != result[j].Pid {
+			return result[i].Pid < result[j].Pid
+		}
+		return result[i].Tid < result[j].Tid
+	})
+	if len(result) > top {
+		result = result[:top]
+	}
+	return result
+}
+
+// printTasks logs the busiest processes and threads
+func printTasks(name string, procs []TaskCpu, threads []TaskCpu) {
+	for _, p := range procs {
+		log.Printf("%s -- top process %d (%s): %.0fm, %.2fs", name, p.Pid, p.Command, p.Millicores, p.CpuSeconds)
+	}
+	for _, t := range threads {
+		log.Printf("%s -- top thread %d of %d (%s): %.0fm, %.2fs", name, t.Tid, t.Pid, t.Command, t.Millicores, t.CpuSeconds)
+	}
+}
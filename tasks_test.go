@@ -0,0 +1,75 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadTaskStat(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "stat")
+	// the command has spaces and parentheses, utime 250 and stime 50 ticks
+	stat := "4242 (my (weird) app) S 1 4242 4242 0 -1 4194304 100 0 0 0 250 50 0 0 20 0 1 0 100 0 0\n"
+	if err := os.WriteFile(path, []byte(stat), 0644); err != nil {
+		t.Fatal(err)
+	}
+	command, ticks, err := readTaskStat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if command != "my (weird) app" || ticks != 300 {
+		t.Errorf("readTaskStat() = %q, %v, want \"my (weird) app\", 300", command, ticks)
+	}
+
+	if err := os.WriteFile(path, []byte("4242 (app) S 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readTaskStat(path); err == nil {
+		t.Error("readTaskStat() of a truncated stat succeeds")
+	}
+}
+
+func TestTopTasks(t *testing.T) {
+
+	tasks := map[int]*taskCpu{
+		10: {pid: 10, command: "busy", base: 100, last: 300},
+		11: {pid: 11, command: "tie", base: 0, last: 50},
+		12: {pid: 12, command: "idle", base: 40, last: 40},
+		13: {pid: 13, command: "exited", base: 0, last: 50, gone: true},
+		14: {pid: 14, command: "light", base: 0, last: 10},
+	}
+	// the CPU time in clock ticks over a window of 2 seconds, ties by process ID
+	got := topTasks(tasks, 3, 2)
+	want := []TaskCpu{
+		{Pid: 10, Command: "busy", CpuSeconds: 200.0 / clockTicks, Millicores: 200.0 / clockTicks / 2 * 1000},
+		{Pid: 11, Command: "tie", CpuSeconds: 50.0 / clockTicks, Millicores: 50.0 / clockTicks / 2 * 1000},
+		{Pid: 13, Command: "exited", CpuSeconds: 50.0 / clockTicks, Millicores: 50.0 / clockTicks / 2 * 1000},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("topTasks() = %+v, want %+v", got, want)
+	}
+
+	// the window is taken, the next one starts from the last ticks without the tasks gone
+	if _, ok := tasks[13]; ok {
+		t.Error("the task gone is kept for the next window")
+	}
+	if got := topTasks(tasks, 3, 2); len(got) != 0 {
+		t.Errorf("topTasks() of the next window = %+v, want none", got)
+	}
+}
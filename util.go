@@ -15,6 +15,7 @@
 package main
 
 import (
+    "bufio"
     "fmt"
     "log"
     "os"
@@ -40,29 +41,87 @@ func findIndex(data string, keyword string) int {
 }
 
 //no help to close the file
-func createOutputFile(filename string) *os.File {
+func createOutputFile(filename string) (*os.File, error) {
 
     f, err := os.Create(filename)
     if err != nil {
-        log.Fatal(err)
+        return nil, fileError(errOutput, err)
     }
 
-    return f
+    return f, nil
 }
 
-func countRate(data []string, interval int, percent float64) []float64 {
+// writeOutputFile writes the lines to a new file
+func writeOutputFile(filename string, lines []string) error {
 
-    res := make([]float64, 2)
+    f, err := createOutputFile(filename)
+    if err != nil {
+        return err
+    }
+
+    w := bufio.NewWriter(f)
+    for _, l := range lines {
+        w.WriteString(l + "\n")
+    }
+    if err = w.Flush(); err != nil {
+        f.Close()
+        return fileError(errOutput, err)
+    }
+    if err = f.Close(); err != nil {
+        return fileError(errOutput, err)
+    }
+    return nil
+}
+
+// countRates turns a series of cumulative counters into rates per millisecond, leaving out the intervals
+// across a reset or a wrap of the counter, and returns how many intervals are left out
+func countRates(data []float64, interval int) ([]float64, int) {
+
+    rates, excluded := markRates(data, interval)
+    float_data := make([]float64, 0, len(rates))
+    for i, r := range rates {
+        if !excluded[i] {
+            float_data = append(float_data, r)
+        }
+    }
+    return float_data, len(rates) - len(float_data)
+}
+
+// markRates turns a series of cumulative counters into the rate per millisecond of every interval,
+// and marks the intervals across a reset or a wrap: the counter goes backwards, e.g. the target restarts,
+// the interface is recreated or a 32-bit counter wraps, and if it comes back right after, the number
+// read was wrong, so the interval back is marked too rather than taken as a spike
+func markRates(data []float64, interval int) ([]float64, []bool) {
+
+    // a rate needs two numbers at least
+    if len(data) < 2 {
+        return nil, nil
+    }
     float_data := make([]float64, len(data)-1)
+    excluded := make([]bool, len(data)-1)
 
     for i := 0; i < len(data)-1; i++ {
-        float_data[i] = (stringToFloat(data[i+1]) - stringToFloat(data[i])) / float64(interval)
+        float_data[i] = (data[i+1] - data[i]) / float64(interval)
+        if data[i+1] < data[i] {
+            excluded[i] = true
+            if i+2 < len(data) && data[i+2] >= data[i] {
+                excluded[i+1] = true
+            }
+        }
     }
+    return float_data, excluded
+}
+
+// countRate returns the average and percentile of the rates of a counter, and the intervals left out
+func countRate(data []float64, interval int, percent float64) ([]float64, int) {
+
+    res := make([]float64, 2)
+    float_data, excluded := countRates(data, interval)
 
     res[0], _ = stats.Mean(float_data)
     res[1], _ = stats.Percentile(float_data, percent)
 
-    return res
+    return res, excluded
 }
 
 func countValue(data []float64, percent float64) []float64 {
@@ -106,3 +165,10 @@ func printResult(workName string, metricName string, avgValue string, pertValue
     log.Printf("%s -- %s Avg: %s, %.2f-Percentile: %s\n", workName, metricName, avgValue, pert, pertValue)
 
 }
+
+// printExcluded logs the intervals of a counter left out of its rates
+func printExcluded(workName string, metricName string, excluded int) {
+    if excluded > 0 {
+        log.Printf("%s -- %s: %d intervals across counter resets are excluded\n", workName, metricName, excluded)
+    }
+}
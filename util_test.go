@@ -0,0 +1,79 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMarkRates(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		data     []float64
+		rates    []float64
+		excluded []bool
+	}{
+		{"empty", nil, nil, nil},
+		{"single", []float64{5}, nil, nil},
+		{"steady", []float64{0, 10, 30, 60}, []float64{1, 2, 3}, []bool{false, false, false}},
+		{"flat", []float64{7, 7, 7}, []float64{0, 0}, []bool{false, false}},
+		// the target restarts, the counter goes on from its new start
+		{"reset", []float64{100, 200, 10, 40}, []float64{10, -19, 3}, []bool{false, true, false}},
+		// a wrong number read, the counter comes back right after
+		{"glitch", []float64{100, 200, 0, 300, 400}, []float64{10, -20, 30, 10}, []bool{false, true, true, false}},
+		{"wrap", []float64{4294967000, 4294967290, 200, 500}, []float64{29, -429496709, 30}, []bool{false, true, false}},
+		{"reset at the end", []float64{100, 200, 10}, []float64{10, -19}, []bool{false, true}},
+		{"resets in a row", []float64{100, 50, 20, 30}, []float64{-5, -3, 1}, []bool{true, true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rates, excluded := markRates(tt.data, 10)
+			if !reflect.DeepEqual(rates, tt.rates) || !reflect.DeepEqual(excluded, tt.excluded) {
+				t.Errorf("markRates(%v) = %v, %v, want %v, %v", tt.data, rates, excluded, tt.rates, tt.excluded)
+			}
+		})
+	}
+}
+
+func TestCountRates(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		data     []float64
+		rates    []float64
+		excluded int
+	}{
+		{"empty", nil, []float64{}, 0},
+		{"steady", []float64{0, 10, 30, 60}, []float64{1, 2, 3}, 0},
+		{"reset", []float64{100, 200, 10, 40}, []float64{10, 3}, 1},
+		{"glitch", []float64{100, 200, 0, 300, 400}, []float64{10, 10}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rates, excluded := countRates(tt.data, 10)
+			if !reflect.DeepEqual(rates, tt.rates) || excluded != tt.excluded {
+				t.Errorf("countRates(%v) = %v, %d, want %v, %d", tt.data, rates, excluded, tt.rates, tt.excluded)
+			}
+		})
+	}
+
+	// no negative rate is ever left
+	res, excluded := countRate([]float64{0, 10, 20, 5, 15, 25}, 10, 95)
+	if excluded != 1 || res[0] != 1 || res[1] != 1 {
+		t.Errorf("countRate() = %v, %d, want mean and percentile 1 with 1 interval left out", res, excluded)
+	}
+}
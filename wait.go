@@ -0,0 +1,252 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Wait mode, enabled by --wait-for, blocks until a process matching a selector appears, and profiles it
+// from then on, so the startup of an application is covered from its first milliseconds.
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// the interval of asking Kubernetes API for the container of a Pod
+	podLookupInterval = time.Second
+	// the shortest interval of reading the command line of every process, the span is too short for it
+	commandPollInterval = 50 * time.Millisecond
+)
+
+// targetSelector finds processes by what is known before they start
+type targetSelector struct {
+	// pod, cmd or cgroup
+	kind  string
+	value string
+
+	// cmd: the regular expression of the command line
+	pattern *regexp.Regexp
+	// pod: <namespace>/<pod>[/<container>], found by Kubernetes API
+	namespace, pod, container string
+	kube                      *kubeLookup
+	nextLookup                time.Time
+	containerId               string
+	// cmd: Colibri and the processes it runs under, never matched
+	skipped map[string]bool
+}
+
+func parseTargetSelector(s string) (*targetSelector, error) {
+
+	kind, value, _ := strings.Cut(s, ":")
+	if value == "" {
+		return nil, newError(errUsage, "a selector must be pod:<namespace>/<pod>[/<container>], cmd:<regexp> or cgroup:<pattern>, got %q", s)
+	}
+	sel := &targetSelector{kind: kind, value: value}
+
+	switch kind {
+	case "pod":
+		parts := strings.Split(value, "/")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return nil, newError(errUsage, "a Pod selector must be pod:<namespace>/<pod>[/<container>], got %q", s)
+		}
+		sel.namespace, sel.pod = parts[0], parts[1]
+		if len(parts) == 3 {
+			sel.container = parts[2]
+		}
+	case "cmd":
+		pattern, err := regexp.Compile(value)
+		if err != nil {
+			return nil, newError(errUsage, "malformed command line pattern %q: %v", value, err)
+		}
+		sel.pattern = pattern
+	case "cgroup":
+		if _, err := filepath.Match(value, ""); err != nil {
+			return nil, newError(errUsage, "malformed cgroup pattern %q: %v", value, err)
+		}
+		sel.value = "/" + strings.TrimPrefix(value, "/")
+	default:
+		return nil, newError(errUsage, "a selector must be pod:<namespace>/<pod>[/<container>], cmd:<regexp> or cgroup:<pattern>, got %q", s)
+	}
+	return sel, nil
+}
+
+func (s *targetSelector) String() string {
+	return s.kind + ":" + s.value
+}
+
+// match returns the processes currently matching the selector, in the order of process IDs
+func (s *targetSelector) match(t time.Time) ([]string, error) {
+
+	var pids []int
+	switch s.kind {
+	case "pod":
+		pid, err := s.matchPod(t)
+		if err != nil || pid == 0 {
+			return nil, err
+		}
+		pids = append(pids, pid)
+	case "cmd":
+		pids = s.matchCommand()
+	case "cgroup":
+		// the pattern is matched against the directories relative to the hierarchy
+		dirs, _ := filepath.Glob(cgroupHierarchy() + s.value)
+		for _, dir := range dirs {
+			if pid := firstProcess(dir); pid != 0 {
+				pids = append(pids, pid)
+			}
+		}
+	}
+
+	sort.Ints(pids)
+	matched := make([]string, len(pids))
+	for i, pid := range pids {
+		matched[i] = strconv.Itoa(pid)
+	}
+	return matched, nil
+}
+
+// matchPod returns the first process of the container of the Pod, 0 before it starts.
+// The container is the first one of the Pod spec if not given.
+func (s *targetSelector) matchPod(t time.Time) (int, error) {
+
+	if s.containerId == "" {
+		if t.Before(s.nextLookup) {
+			return 0, nil
+		}
+		s.nextLookup = t.Add(podLookupInterval)
+
+		if s.kube == nil {
+			kube, err := newKubeLookup()
+			if err != nil {
+				return 0, err
+			}
+			s.kube = kube
+		}
+		status, err := s.kube.lookupStatus(s.namespace, s.pod)
+		if err != nil || status == nil {
+			return 0, err
+		}
+		name := s.container
+		if name == "" && len(status.names) > 0 {
+			name = status.names[0]
+		}
+		if s.containerId = status.ids[name]; s.containerId == "" {
+			return 0, nil
+		}
+	}
+
+	containers, err := discoverContainers()
+	if err != nil {
+		return 0, err
+	}
+	for _, c := range containers {
+		if c.containerId == s.containerId {
+			return c.pid, nil
+		}
+	}
+	return 0, nil
+}
+
+// matchCommand lists the processes whose command line matches, except Colibri and its ancestors,
+// e.g. the shell of a wrapping script, whose command lines often hold the pattern as well
+func (s *targetSelector) matchCommand() []int {
+
+	entries, err := os.ReadDir(ProcDir)
+	if err != nil {
+		return nil
+	}
+	if s.skipped == nil {
+		s.skipped = selfAndAncestors()
+	}
+
+	var pids []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || s.skipped[e.Name()] {
+			continue
+		}
+		cmdline, err := os.ReadFile(procPath(e.Name(), "cmdline"))
+		// kernel threads have no command line
+		if err != nil || len(cmdline) == 0 {
+			continue
+		}
+		// the arguments are separated by NUL
+		args := bytes.ReplaceAll(bytes.TrimRight(cmdline, "\x00"), []byte{0}, []byte{' '})
+		if s.pattern.Match(args) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// selfAndAncestors returns the process IDs of Colibri and of its parents up to the first process
+func selfAndAncestors() map[string]bool {
+
+	pids := make(map[string]bool)
+	pid, _ := os.Readlink(ProcDir + "/self")
+	for pid != "" && pid != "0" && !pids[pid] {
+		pids[pid] = true
+		stat, err := os.ReadFile(procPath(pid, "stat"))
+		if err != nil {
+			break
+		}
+		// the parent is field 4, the second after the command name in parentheses
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		if len(fields) < 2 {
+			break
+		}
+		pid = fields[1]
+	}
+	return pids
+}
+
+// waitForTarget polls every span until a process matches the selector, or every commandPollInterval for
+// a command line. It fails once the timeout passes, or Colibri is interrupted.
+func waitForTarget(sel *targetSelector, timeout time.Duration, span time.Duration, interrupt <-chan struct{}) (string, error) {
+
+	if sel.kind == "cmd" && span < commandPollInterval {
+		span = commandPollInterval
+	}
+	start := time.Now()
+	timer := time.NewTimer(0)
+	<-timer.C
+
+	for {
+		t := time.Now()
+		pids, err := sel.match(t)
+		if err != nil {
+			return "", err
+		}
+		if len(pids) > 0 {
+			return pids[0], nil
+		}
+		if t.Sub(start) >= timeout {
+			return "", newError(errTarget, "no process matches %s in %s", sel, timeout)
+		}
+
+		timer.Reset(span)
+		select {
+		case <-timer.C:
+		case <-interrupt:
+			timer.Stop()
+			return "", newError(errInterrupted, "interrupted while waiting for %s", sel)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2022 Carol Hsu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseTargetSelector(t *testing.T) {
+
+	tests := []struct {
+		selector                  string
+		kind, value               string
+		namespace, pod, container string
+		ok                        bool
+	}{
+		{"pod:default/web", "pod", "default/web", "default", "web", "", true},
+		{"pod:default/web/app", "pod", "default/web/app", "default", "web", "app", true},
+		{"pod:default", "", "", "", "", "", false},
+		{"pod:default/", "", "", "", "", "", false},
+		{"pod:/web", "", "", "", "", "", false},
+		{"pod:default/web/app/more", "", "", "", "", "", false},
+		{"cmd:^nginx: master", "cmd", "^nginx: master", "", "", "", true},
+		{"cmd:nginx(", "", "", "", "", "", false},
+		{"cgroup:kubepods.slice/*/*pod1f4b*/*", "cgroup", "/kubepods.slice/*/*pod1f4b*/*", "", "", "", true},
+		{"cgroup:/system.slice/nginx.service", "cgroup", "/system.slice/nginx.service", "", "", "", true},
+		{"cgroup:[", "", "", "", "", "", false},
+		{"cmd:", "", "", "", "", "", false},
+		{"", "", "", "", "", "", false},
+		{"nginx", "", "", "", "", "", false},
+		{"name:nginx", "", "", "", "", "", false},
+	}
+	for _, tt := range tests {
+		sel, err := parseTargetSelector(tt.selector)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseTargetSelector(%q) error = %v, want ok %v", tt.selector, err, tt.ok)
+			continue
+		}
+		if err != nil {
+			if code := exitCode(err); code != int(errUsage) {
+				t.Errorf("parseTargetSelector(%q) exit code = %d, want %d", tt.selector, code, errUsage)
+			}
+			continue
+		}
+		got := []string{sel.kind, sel.value, sel.namespace, sel.pod, sel.container}
+		want := []string{tt.kind, tt.value, tt.namespace, tt.pod, tt.container}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("parseTargetSelector(%q) = %q, want %q", tt.selector, got, want)
+		}
+	}
+}
+
+// fakeProc writes a /proc of processes by ID, with their parents and command lines
+func fakeProc(t *testing.T, self string, procs map[string][2]string) {
+	dir := t.TempDir()
+	for pid, p := range procs {
+		if err := os.MkdirAll(filepath.Join(dir, pid), 0755); err != nil {
+			t.Fatal(err)
+		}
+		stat := pid + " (a (b) c) S " + p[0] + " 1 1 0 -1\n"
+		if err := os.WriteFile(filepath.Join(dir, pid, "stat"), []byte(stat), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, pid, "cmdline"), []byte(p[1]), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(self, filepath.Join(dir, "self")); err != nil {
+		t.Fatal(err)
+	}
+	saved := ProcDir
+	ProcDir = dir
+	t.Cleanup(func() { ProcDir = saved })
+}
+
+func TestMatchCommand(t *testing.T) {
+
+	fakeProc(t, "30", map[string][2]string{
+		"1":  {"0", "/sbin/init\x00"},
+		"2":  {"0", ""},
+		"20": {"1", "sh\x00-c\x00colibri-v2 --wait-for cmd:nginx\x00"},
+		"30": {"20", "colibri-v2\x00--wait-for\x00cmd:nginx\x00"},
+		"40": {"1", "nginx: master process\x00"},
+		"41": {"40", "nginx: worker process\x00"},
+		"50": {"1", "tail\x00-f\x00/var/log/nginx/access.log\x00"},
+	})
+
+	sel, err := parseTargetSelector("cmd:^nginx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sel.matchCommand(); !reflect.DeepEqual(got, []int{40, 41}) {
+		t.Errorf("matchCommand(^nginx) = %v, want [40 41]", got)
+	}
+
+	// the wrapping shell and Colibri match the pattern, but are never taken
+	sel, _ = parseTargetSelector("cmd:nginx")
+	if got := sel.matchCommand(); !reflect.DeepEqual(got, []int{40, 41, 50}) {
+		t.Errorf("matchCommand(nginx) = %v, want [40 41 50]", got)
+	}
+	if want := map[string]bool{"1": true, "20": true, "30": true}; !reflect.DeepEqual(sel.skipped, want) {
+		t.Errorf("skipped %v, want %v", sel.skipped, want)
+	}
+}